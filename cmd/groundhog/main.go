@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"flag"
@@ -9,10 +10,12 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/tabjy/groundhog/client"
 	"github.com/tabjy/groundhog/cmd/groundhog/internal"
 	"github.com/tabjy/groundhog/common/protocol"
+	"github.com/tabjy/groundhog/local"
 	"github.com/tabjy/groundhog/server"
 	"github.com/tabjy/groundhog/socks5"
 	"github.com/tabjy/yagl"
@@ -28,13 +31,18 @@ var (
 
 	ciphers string
 
-	socks5Host string
-	socks5Port int
+	socks5Host    string
+	socks5Port    int
+	socks5Network string
 
 	logger   yagl.Logger
 	logLevel string
 )
 
+// shutdownTimeout is how long connections are given to finish on the first
+// ctrl+c, before being force closed.
+const shutdownTimeout = 30 * time.Second
+
 func init() {
 	flag.BoolVar(&isServerMode, "server", false, "run in server mode")
 	flag.BoolVar(&isClientMode, "client", false, "run in client mode")
@@ -47,6 +55,7 @@ func init() {
 
 	flag.StringVar(&socks5Host, "socks5-host", "localhost", "hostname for local SOCKS5 server")
 	flag.IntVar(&socks5Port, "socks5-port", 1080, "port for local SOCKS5 server")
+	flag.StringVar(&socks5Network, "socks5-network", "tcp", `network for local SOCKS5 server, "tcp" or "unix" (socks5-host is then a socket path)`)
 
 	flag.StringVar(&logLevel, "log-level", "info", "logging level")
 }
@@ -162,8 +171,14 @@ func serverMode() {
 				if !shuttingDown {
 					logger.Info("server shutdown in progress, press ctrl+c again for emergency shutdown")
 					shuttingDown = true
-					srv.Shutdown()
-					os.Exit(0)
+					go func() {
+						// waits for connections to finish, unless signaled
+						// again or timed out
+						ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+						defer cancel()
+						srv.Shutdown(ctx)
+						os.Exit(0)
+					}()
 				} else {
 					logger.Info("emergency shutdown issued")
 					os.Exit(0)
@@ -220,12 +235,18 @@ func clientMode() {
 		logger.Fatalf("unrecognized cipher method: %s", ciphers)
 	}
 
-	srv := socks5.NewServer(&socks5.Config{
-		Host:   socks5Host,
-		Port:   uint16(socks5Port),
-		Dialer: dialer,
-		Logger: logger,
-	})
+	srv, err := local.NewServer(&socks5.Config{
+		Host:    socks5Host,
+		Port:    uint16(socks5Port),
+		Network: socks5Network,
+		Logger:  logger,
+
+		// the local SOCKS5 server is meant for local applications
+		AllowNoAuth: true,
+	}, dialer)
+	if err != nil {
+		logger.Fatalf("invalid SOCKS5 configuration: %s", err)
+	}
 
 	go func() {
 		sigs := make(chan os.Signal, 1)
@@ -238,8 +259,14 @@ func clientMode() {
 				if !shuttingDown {
 					logger.Info("client shutdown in progress, press ctrl+c again for emergency shutdown")
 					shuttingDown = true
-					srv.Shutdown()
-					os.Exit(0)
+					go func() {
+						// waits for connections to finish, unless signaled
+						// again or timed out
+						ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+						defer cancel()
+						srv.Shutdown(ctx)
+						os.Exit(0)
+					}()
 				} else {
 					logger.Info("emergency shutdown issued")
 					os.Exit(0)
@@ -271,4 +298,4 @@ func keyGenMode() {
 	}
 
 	logger.Infof("Done. PEM encoded key pair wrote to %s", keyPath)
-}
\ No newline at end of file
+}
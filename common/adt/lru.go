@@ -0,0 +1,210 @@
+package adt
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUSet is an implement of Set ADT holding at most a fixed number of
+// elements. Once full, adding a new element evicts the least recently added
+// or looked up one.
+type LRUSet struct {
+	capacity int
+	items    map[interface{}]*list.Element
+	order    *list.List // front is the most recently used
+	mu       sync.Mutex
+}
+
+// NewLRUSet returns a LRUSet holding at most capacity elements. capacity must
+// be positive.
+func NewLRUSet(capacity int) Set {
+	if capacity <= 0 {
+		panic("adt: non-positive LRUSet capacity")
+	}
+
+	return &LRUSet{
+		capacity: capacity,
+		items:    make(map[interface{}]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Add implements Add in Set ADT.
+func (s *LRUSet) Add(element interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, contains := s.items[element]; contains {
+		s.order.MoveToFront(e)
+		return
+	}
+
+	if s.order.Len() >= s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value)
+	}
+	s.items[element] = s.order.PushFront(element)
+}
+
+// Remove implements Remove in Set ADT.
+func (s *LRUSet) Remove(element interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, contains := s.items[element]
+	if contains {
+		s.order.Remove(e)
+		delete(s.items, element)
+	}
+	return contains
+}
+
+// Contains implements Contains in Set ADT. A element found is marked as
+// recently used.
+func (s *LRUSet) Contains(element interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, contains := s.items[element]
+	if contains {
+		s.order.MoveToFront(e)
+	}
+	return contains
+}
+
+// Clear implements Clear in Set ADT.
+func (s *LRUSet) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = make(map[interface{}]*list.Element)
+	s.order.Init()
+}
+
+// Len implements Len in Set ADT.
+func (s *LRUSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// Empty implements Empty in Set ADT.
+func (s *LRUSet) Empty() bool {
+	return s.Len() == 0
+}
+
+// ForEach implements ForEach in Set ADT, from the most recently used element
+// to the least.
+//
+// IMPORTANT: ForEach causes the set to be locked until finish iterating all
+// elements. Therefore, calling any of Add, Remove, Contains, and Clear will
+// result in a dead lock. Do these ops in a separate goroutine!
+func (s *LRUSet) ForEach(fn func(interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		fn(e.Value)
+	}
+}
+
+// Filter implements Filter in Set ADT.
+//
+// IMPORTANT: Filter causes the set to be locked until finish iterating all
+// elements. Therefore, calling any of Add, Remove, Contains, and Clear will
+// result in a dead lock. Do these ops in a separate goroutine!
+func (s *LRUSet) Filter(fn func(interface{}) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.order.Front(); e != nil; {
+		next := e.Next()
+		if keep := fn(e.Value); !keep {
+			s.order.Remove(e)
+			delete(s.items, e.Value)
+		}
+		e = next
+	}
+}
+
+// LRUMap is a map holding at most a fixed number of entries. Once full,
+// putting a new key evicts the least recently put or looked up entry.
+type LRUMap struct {
+	capacity int
+	items    map[interface{}]*list.Element
+	order    *list.List // front is the most recently used
+	mu       sync.Mutex
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// NewLRUMap returns a LRUMap holding at most capacity entries. capacity must
+// be positive.
+func NewLRUMap(capacity int) *LRUMap {
+	if capacity <= 0 {
+		panic("adt: non-positive LRUMap capacity")
+	}
+
+	return &LRUMap{
+		capacity: capacity,
+		items:    make(map[interface{}]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns value of key, and whether it's present. An entry found is marked
+// as recently used.
+func (m *LRUMap) Get(key interface{}) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, contains := m.items[key]
+	if !contains {
+		return nil, false
+	}
+	m.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// Put sets value of key, evicting the least recently used entry if full.
+func (m *LRUMap) Put(key, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, contains := m.items[key]; contains {
+		e.Value.(*lruEntry).value = value
+		m.order.MoveToFront(e)
+		return
+	}
+
+	if m.order.Len() >= m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*lruEntry).key)
+	}
+	m.items[key] = m.order.PushFront(&lruEntry{key, value})
+}
+
+// Remove removes key, and returns whether it was present.
+func (m *LRUMap) Remove(key interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, contains := m.items[key]
+	if contains {
+		m.order.Remove(e)
+		delete(m.items, key)
+	}
+	return contains
+}
+
+// Len returns the number of entries.
+func (m *LRUMap) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.order.Len()
+}
@@ -73,7 +73,9 @@ func (s *HashSet) Clear() {
 
 // Len implements Len in Set ADT.
 func (s *HashSet) Len() int {
-	// this is atomic already
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return len(s.items)
 }
 
@@ -16,3 +16,51 @@ type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
+
+// Resolver interface resolves hostnames for a SOCKS5 server, where resolution
+// has to be done by the server itself, rather than left to a Dialer.
+type Resolver interface {
+	Resolve(ctx context.Context, host string) (net.IP, error)
+}
+
+// MultiResolver is a Resolver also able to return all addresses found for a
+// host, e.g. both IPv4 and IPv6 addresses of a dual-stack host.
+type MultiResolver interface {
+	Resolver
+	ResolveAll(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// NetResolver adapts a net.Resolver into a MultiResolver. The zero value for
+// NetResolver uses net.DefaultResolver.
+type NetResolver struct {
+	Resolver *net.Resolver
+}
+
+// Resolve implements Resolve in Resolver. The first address found is returned.
+func (r *NetResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// ResolveAll implements ResolveAll in MultiResolver, in the order returned by
+// the underlying net.Resolver.
+func (r *NetResolver) ResolveAll(ctx context.Context, host string) ([]net.IP, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
@@ -0,0 +1,235 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrAuthentication is returned when a chunk fails authentication, i.e. the
+// ciphertext has been tampered with or the keys do not match.
+var ErrAuthentication = errors.New("message authentication failed")
+
+// AEADEncryptDecrypter contains information needed to encrypt/decrypt a
+// connection with an AEAD cipher, framed in the same way as shadowsocks AEAD.
+// Each direction begins with a random salt, from which a per-connection
+// subkey is derived, followed by any number of chunks.
+//
+//	+------+----------------------+------------------------+
+//	| SALT | [LENGTH][LENGTH TAG] | [PAYLOAD][PAYLOAD TAG] | ...
+//	+------+----------------------+------------------------+
+//	| Key  |       2 + Tag        |    Variable + Tag      |
+//	+------+----------------------+------------------------+
+//
+// The salt is as long as the key. LENGTH is a big-endian uint16 no larger than
+// MaxChunkSize. The nonce starts at zero and is incremented after each seal.
+type AEADEncryptDecrypter struct {
+	EncryptKey []byte
+	DecryptKey []byte
+
+	// AEAD constructs a cipher.AEAD from a subkey, e.g. NewAESGCM or
+	// chacha20poly1305.New.
+	AEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewAESGCM returns AES-GCM with a key of 16, 24, or 32 bytes. It can be used
+// as AEADEncryptDecrypter.AEAD.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ed *AEADEncryptDecrypter) check() error {
+	if ed.AEAD == nil {
+		return errors.New("AEAD must be set")
+	}
+
+	if ed.EncryptKey == nil {
+		return fmt.Errorf("%w: both EncryptKey and DecryptKey must be set", ErrMissingEncryptKey)
+	}
+	if ed.DecryptKey == nil {
+		return fmt.Errorf("%w: both EncryptKey and DecryptKey must be set", ErrMissingDecryptKey)
+	}
+
+	return nil
+}
+
+func (ed *AEADEncryptDecrypter) newSealer() (*aeadSealer, error) {
+	salt := make([]byte, len(ed.EncryptKey))
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := ed.newAEAD(ed.EncryptKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aeadSealer{
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		salt:  salt,
+	}, nil
+}
+
+func (ed *AEADEncryptDecrypter) newOpener() *aeadOpener {
+	return &aeadOpener{
+		key:     ed.DecryptKey,
+		newAEAD: ed.newAEAD,
+	}
+}
+
+func (ed *AEADEncryptDecrypter) newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return ed.AEAD(subkey)
+}
+
+// Ciphertext takes a duplex net.Conn with plaintext, and returns a
+// corresponding ciphertext net.Conn. Any ciphertext written to the returned
+// net.Conn will be authenticated, decrypted and written to plaintext. Any
+// plaintext read from plaintext will be encrypted and read from the returned
+// net.Conn.
+func (ed *AEADEncryptDecrypter) Ciphertext(plaintext net.Conn) (net.Conn, error) {
+	if err := ed.check(); err != nil {
+		return nil, err
+	}
+
+	s, err := ed.newSealer()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &CipherConn{Conn: plaintext, keyLen: len(ed.EncryptKey)}
+	pipe := newOpeningWriter(plaintext, ed.newOpener(), conn.fail)
+	conn.ReadWriter = &readWriter{
+		Reader: &sealingReader{r: plaintext, sealer: s},
+		Writer: pipe,
+		pipes:  []*pipeWriter{pipe},
+	}
+	return conn, nil
+}
+
+// Plaintext takes a duplex net.Conn with ciphertext, and returns a
+// corresponding plaintext net.Conn. Any plaintext written to the returned
+// net.Conn will be encrypted and written to ciphertext. Any ciphertext read
+// from ciphertext will be authenticated, decrypted and read from the returned
+// net.Conn.
+func (ed *AEADEncryptDecrypter) Plaintext(ciphertext net.Conn) (net.Conn, error) {
+	if err := ed.check(); err != nil {
+		return nil, err
+	}
+
+	s, err := ed.newSealer()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &CipherConn{Conn: ciphertext, keyLen: len(ed.EncryptKey)}
+	conn.ReadWriter = &readWriter{
+		Reader: &chunkReader{r: ciphertext, opener: ed.newOpener(), fail: conn.fail},
+		Writer: &chunkWriter{w: ciphertext, sealer: s},
+	}
+	return conn, nil
+}
+
+type aeadSealer struct {
+	aead  cipher.AEAD
+	nonce []byte
+	salt  []byte // sent ahead of the first chunk
+}
+
+func (s *aeadSealer) seal(dst, plaintext []byte) ([]byte, error) {
+	if s.salt != nil {
+		dst = append(dst, s.salt...)
+		s.salt = nil
+	}
+
+	length := []byte{byte(len(plaintext) >> 8), byte(len(plaintext))}
+	dst = s.aead.Seal(dst, s.nonce, length, nil)
+	increment(s.nonce)
+	dst = s.aead.Seal(dst, s.nonce, plaintext, nil)
+	increment(s.nonce)
+
+	return dst, nil
+}
+
+type aeadOpener struct {
+	key     []byte
+	newAEAD func(key, salt []byte) (cipher.AEAD, error)
+
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (o *aeadOpener) open(r io.Reader) ([]byte, error) {
+	if o.aead == nil {
+		salt := make([]byte, len(o.key))
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return nil, err
+		}
+
+		aead, err := o.newAEAD(o.key, salt)
+		if err != nil {
+			return nil, err
+		}
+		o.aead = aead
+		o.nonce = make([]byte, aead.NonceSize())
+	}
+
+	overhead := o.aead.Overhead()
+
+	buf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	length, err := o.aead.Open(buf[:0], o.nonce, buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk length: %w", ErrAuthentication)
+	}
+	increment(o.nonce)
+
+	size := int(length[0])<<8 | int(length[1])
+	if size > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size %d exceeds maximum %d", size, MaxChunkSize)
+	}
+
+	buf = make([]byte, size+overhead)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	payload, err := o.aead.Open(buf[:0], o.nonce, buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk payload: %w", ErrAuthentication)
+	}
+	increment(o.nonce)
+
+	return payload, nil
+}
+
+// increment treats b as a little-endian counter and adds one to it.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAEADTampered(t *testing.T) {
+	newAEAD := func() *AEADEncryptDecrypter {
+		return &AEADEncryptDecrypter{
+			EncryptKey: append([]byte(nil), testKey...),
+			DecryptKey: append([]byte(nil), testKey...),
+			AEAD:       NewAESGCM,
+		}
+	}
+
+	err := readTampered(t, newAEAD(), newAEAD(), []byte("groundhog"))
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("error %v, want %v", err, ErrAuthentication)
+	}
+}
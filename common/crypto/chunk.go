@@ -0,0 +1,217 @@
+package crypto
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// BufferSize is the size of buffers used to copy data between connections
+// internally. Buffers are recycled through a sync.Pool, so connections
+// opened and closed in quick succession don't allocate a buffer each.
+var BufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, BufferSize)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if len(*buf) != BufferSize {
+		// BufferSize changed since buf was allocated
+		*buf = make([]byte, BufferSize)
+	}
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
+
+// MaxChunkSize is the maximum payload size of a single chunk. A length field
+// larger than MaxChunkSize is treated as a malformed chunk, so a peer cannot
+// force an unbounded allocation.
+const MaxChunkSize = 0x3FFF
+
+// sealer seals a plaintext chunk into a self-contained frame, appending it to
+// dst.
+type sealer interface {
+	seal(dst, plaintext []byte) ([]byte, error)
+}
+
+// opener reads exactly one frame from r and returns its plaintext. opener
+// returns io.EOF only if r is drained at a frame boundary.
+type opener interface {
+	open(r io.Reader) ([]byte, error)
+}
+
+// chunkWriter splits everything written to it into chunks, seals them, and
+// writes the frames to w.
+type chunkWriter struct {
+	w      io.Writer
+	sealer sealer
+	buf    []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxChunkSize {
+			chunk = chunk[:MaxChunkSize]
+		}
+
+		if cw.buf, err = cw.sealer.seal(cw.buf[:0], chunk); err != nil {
+			return n, err
+		}
+		if _, err = cw.w.Write(cw.buf); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// chunkReader reads frames from r and returns their plaintext. If a frame
+// fails to open, fail (if any) is called, so the connection can be torn down
+// before any further data is trusted.
+type chunkReader struct {
+	r      io.Reader
+	opener opener
+	fail   func(err error)
+
+	buf []byte
+	err error
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+
+		cr.buf, cr.err = cr.opener.open(cr.r)
+		if cr.err != nil && cr.err != io.EOF && cr.fail != nil {
+			cr.fail(cr.err)
+		}
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// sealingReader reads plaintext from r and returns sealed frames.
+type sealingReader struct {
+	r      io.Reader
+	sealer sealer
+
+	plaintext []byte
+	sealed    []byte
+	buf       []byte
+	err       error
+}
+
+func (sr *sealingReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+
+		if sr.plaintext == nil {
+			sr.plaintext = make([]byte, MaxChunkSize)
+		}
+
+		var n int
+		n, sr.err = sr.r.Read(sr.plaintext)
+		if n > 0 {
+			var err error
+			if sr.sealed, err = sr.sealer.seal(sr.sealed[:0], sr.plaintext[:n]); err != nil {
+				return 0, err
+			}
+			sr.buf = sr.sealed
+		}
+	}
+
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// pipeWriter accepts data written to it, which is read by a goroutine on the
+// far end of an in-memory pipe through a decoder, and the decoded data is
+// written to w. pipeWriter is for decoders which consume an io.Reader (e.g.
+// chunkReader), while data arrives through writes. If decoding or writing to w
+// fails, fail (if any) is called.
+type pipeWriter struct {
+	pw   net.Conn
+	done chan struct{}
+	err  error
+}
+
+func newPipeWriter(w io.Writer, decoder func(r io.Reader) io.Reader, fail func(err error)) *pipeWriter {
+	pr, pw := net.Pipe()
+	ow := &pipeWriter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(ow.done)
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+
+		_, ow.err = io.CopyBuffer(w, decoder(pr), *buf)
+		if ow.err != nil && fail != nil {
+			fail(ow.err)
+		}
+		pr.Close()
+	}()
+
+	return ow
+}
+
+// newOpeningWriter returns a pipeWriter accepting frames and writing their
+// plaintext to w.
+func newOpeningWriter(w io.Writer, o opener, fail func(err error)) *pipeWriter {
+	return newPipeWriter(w, func(r io.Reader) io.Reader {
+		return &chunkReader{r: r, opener: o, fail: fail}
+	}, fail)
+}
+
+func (ow *pipeWriter) Write(p []byte) (int, error) {
+	n, err := ow.pw.Write(p)
+	if err != nil {
+		select {
+		case <-ow.done:
+			if ow.err != nil {
+				return n, ow.err
+			}
+		default:
+		}
+	}
+	return n, err
+}
+
+func (ow *pipeWriter) SetWriteDeadline(t time.Time) error {
+	return ow.pw.SetWriteDeadline(t)
+}
+
+func (ow *pipeWriter) Close() error {
+	return ow.pw.Close()
+}
+
+// closeWrite closes the pipe, and waits for everything written so far to be
+// decoded and written to w.
+func (ow *pipeWriter) closeWrite() error {
+	ow.pw.Close()
+	<-ow.done
+	return ow.err
+}
@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// MaxCompressionRatio is the maximum ratio of decompressed to compressed
+// bytes accepted over a connection with compression enabled, once the first
+// compressionAllowance bytes have been decompressed. It guards against
+// compression bombs, which expand a few bytes on the wire into a flood of
+// plaintext.
+var MaxCompressionRatio int64 = 100
+
+// compressionAllowance is decompressed bytes allowed regardless of
+// MaxCompressionRatio, so short and highly repetitive messages are not
+// rejected.
+const compressionAllowance = 1 << 20
+
+// ErrCompressionRatio is returned when decompressed data exceeds
+// MaxCompressionRatio.
+var ErrCompressionRatio = errors.New("decompressed data exceeds maximum compression ratio")
+
+// compressingWriter compresses data written to it, flushing after each write.
+type compressingWriter struct {
+	fw *flate.Writer
+}
+
+func newCompressingWriter(w io.Writer) *compressingWriter {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression) // never fails with a valid level
+	return &compressingWriter{fw}
+}
+
+func (cw *compressingWriter) Write(p []byte) (int, error) {
+	n, err := cw.fw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, cw.fw.Flush()
+}
+
+// compressingReader reads data from r and returns it compressed, flushing
+// after each read.
+type compressingReader struct {
+	r   io.Reader
+	fw  *flate.Writer
+	buf bytes.Buffer
+	tmp []byte
+	err error
+}
+
+func newCompressingReader(r io.Reader) *compressingReader {
+	cr := &compressingReader{
+		r:   r,
+		tmp: make([]byte, MaxChunkSize),
+	}
+	cr.fw, _ = flate.NewWriter(&cr.buf, flate.DefaultCompression) // never fails with a valid level
+	return cr
+}
+
+func (cr *compressingReader) Read(p []byte) (int, error) {
+	for cr.buf.Len() == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+
+		n, err := cr.r.Read(cr.tmp)
+		if n > 0 {
+			cr.fw.Write(cr.tmp[:n]) // writes to bytes.Buffer never fail
+			cr.fw.Flush()
+		}
+		if err != nil {
+			if err == io.EOF {
+				cr.fw.Close()
+			}
+			cr.err = err
+		}
+	}
+
+	return cr.buf.Read(p)
+}
+
+// decompressingReader reads compressed data from r and returns it
+// decompressed.
+type decompressingReader struct {
+	in  countingReader
+	fr  io.Reader
+	out int64
+}
+
+func newDecompressingReader(r io.Reader) io.Reader {
+	dr := &decompressingReader{in: countingReader{r: r}}
+	dr.fr = flate.NewReader(&dr.in)
+	return dr
+}
+
+func (dr *decompressingReader) Read(p []byte) (int, error) {
+	n, err := dr.fr.Read(p)
+
+	dr.out += int64(n)
+	if dr.out > dr.in.n*MaxCompressionRatio+compressionAllowance {
+		return 0, ErrCompressionRatio
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		// peer closed without a final block, which is fine since every write
+		// is flushed
+		err = io.EOF
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -1,86 +1,532 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"net"
-	"crypto/cipher"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tabjy/groundhog/common/util"
+	"golang.org/x/crypto/chacha20"
+)
+
+// EncryptDecrypter wraps connections with encryption, as done by
+// StreamEncryptDecrypter and AEADEncryptDecrypter. Ciphertext is used on the
+// side producing ciphertext from plaintext, and Plaintext on the other side.
+type EncryptDecrypter interface {
+	Ciphertext(plaintext net.Conn) (net.Conn, error)
+	Plaintext(ciphertext net.Conn) (net.Conn, error)
+}
+
+// Errors returned when a StreamEncryptDecrypter or AEADEncryptDecrypter is
+// misconfigured, wrapped with details, so they can be told apart with
+// errors.Is.
+var (
+	ErrMissingEncryptKey = errors.New("missing encrypt key")
+	ErrMissingDecryptKey = errors.New("missing decrypt key")
+	ErrMissingIV         = errors.New("missing IV")
+	ErrMissingIVSize     = errors.New("missing IV size")
+	ErrInvalidKeySize    = errors.New("invalid key size")
+	ErrInvalidIVSize     = errors.New("invalid IV size")
+	ErrModeMismatch      = errors.New("mismatched cipher modes")
 )
 
 type readWriter struct {
 	io.Reader
 	io.Writer
+
+	pipes []*pipeWriter // in-memory pipes between Writer and the net.Conn
+}
+
+// Close closes in-memory pipes, so goroutines reading them exit.
+func (rw *readWriter) Close() error {
+	for _, pipe := range rw.pipes {
+		pipe.Close()
+	}
+	return nil
+}
+
+// SetWriteDeadline sets write deadline on in-memory pipes.
+func (rw *readWriter) SetWriteDeadline(t time.Time) error {
+	for _, pipe := range rw.pipes {
+		if err := pipe.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
 }
 
 // StreamEncryptDecrypter contains information needed to encrypt/decrypt a
 // connection.
 type StreamEncryptDecrypter struct {
+	// PassThrough disables encryption, for debugging and comparing
+	// performance against. Ciphertext and Plaintext return the connection
+	// wrapped in a CipherConn copying bytes unchanged, and every other field
+	// is ignored. Both ends must agree on PassThrough. Never use it where
+	// confidentiality matters.
+	PassThrough bool
+
 	EncryptKey []byte
 	DecryptKey []byte
 
 	StreamEncrypter func(block cipher.Block, iv []byte) cipher.Stream
 	StreamDecrypter func(block cipher.Block, iv []byte) cipher.Stream
 
+	// AllowAsymmetricModes disables the check that StreamEncrypter and
+	// StreamDecrypter belong to the same registered cipher mode, see SetMode.
+	AllowAsymmetricModes bool
+
+	// BlockFactory constructs the cipher.Block passed to StreamEncrypter and
+	// StreamDecrypter. If nil, aes.NewCipher is used.
+	BlockFactory func(key []byte) (cipher.Block, error)
+
+	// StreamFactory, if set, constructs cipher streams directly from a key and
+	// an IV, for stream ciphers without an underlying cipher.Block (e.g.
+	// NewChaCha20Stream). StreamEncrypter and StreamDecrypter are ignored.
+	StreamFactory func(key, iv []byte) (cipher.Stream, error)
+
 	EncryptStream cipher.Stream
 	DecryptStream cipher.Stream
 
 	EncryptIV []byte
 	DecryptIV []byte
+
+	// Salted enables per-connection subkeys. Each direction sends a random
+	// SaltSize-byte salt ahead of its ciphertext, and cipher streams are keyed
+	// with DeriveSubkey(key, salt, len(key)) instead of the key itself. Both
+	// ends must agree on Salted.
+	Salted bool
+
+	EncryptSalt []byte // Generated if nil. Only used if Salted.
+	DecryptSalt []byte // Read from the peer. Only used if Salted.
+
+	// NegotiateIV enables in-band IVs. EncryptIV is generated randomly for
+	// each connection and sent ahead of the ciphertext (after the salt, if
+	// Salted), and DecryptIV is read from the peer. Both ends must agree on
+	// NegotiateIV.
+	NegotiateIV bool
+
+	// IVSize is the length of IVs generated by NegotiateIV. If 0, block size
+	// of the cipher would be used. It must be set if StreamFactory is used.
+	IVSize int
+
+	// IVCache, if set, detects a key and IV pair being used twice, in which
+	// case ErrIVReuse is returned. Off by default, as it costs memory.
+	IVCache *IVCache
+
+	// Compress enables deflate compression of plaintext before encryption.
+	// Each write is flushed as is, so compression doesn't delay delivery. On
+	// decompression, data expanding more than MaxCompressionRatio times is
+	// rejected. Both ends must agree on Compress.
+	Compress bool
+
+	// Authenticated enables tamper detection. Ciphertext is framed into chunks,
+	// each followed by an HMAC-SHA256 tag, which is verified before any
+	// plaintext of the chunk is released. See MACSize for the frame layout.
+	// Both ends must agree on Authenticated.
+	Authenticated bool
+
+	// RekeyAfterBytes and RekeyAfterDuration make the encrypt side switch to
+	// a new subkey after encrypting that many bytes, or after that much time
+	// since the last rekey, whichever comes first. Zero means never. The rekey
+	// point is signaled in-band, so the peer follows regardless of its own
+	// settings. Rekeying requires Authenticated. Time is only checked as
+	// chunks are sent, so an idle connection rekeys along with its next chunk.
+	RekeyAfterBytes    uint64
+	RekeyAfterDuration time.Duration
+
+	encryptMACKey []byte
+	decryptMACKey []byte
+
+	encryptSubkey     []byte // current key of EncryptStream, if Authenticated
+	decryptSubkey     []byte // current key of DecryptStream, if Authenticated
+	encryptGeneration uint64 // number of rekeys of EncryptStream
+	decryptGeneration uint64 // number of rekeys of DecryptStream
+
+	bytesEncrypted atomic.Uint64
+	bytesDecrypted atomic.Uint64
+
+	mode CipherMode // set by NewStreamEncryptDecrypter, 0 if unknown
+}
+
+// Stats returns number of bytes encrypted and decrypted so far. It's safe to
+// be called while connections using ed are live.
+func (ed *StreamEncryptDecrypter) Stats() (enc, dec uint64) {
+	return ed.bytesEncrypted.Load(), ed.bytesDecrypted.Load()
+}
+
+// encrypter returns EncryptStream counting bytes it encrypts.
+func (ed *StreamEncryptDecrypter) encrypter() cipher.Stream {
+	return &countingStream{ed.EncryptStream, &ed.bytesEncrypted}
+}
+
+// decrypter returns DecryptStream counting bytes it decrypts.
+func (ed *StreamEncryptDecrypter) decrypter() cipher.Stream {
+	return &countingStream{ed.DecryptStream, &ed.bytesDecrypted}
+}
+
+type countingStream struct {
+	cipher.Stream
+	n *atomic.Uint64
+}
+
+func (s *countingStream) XORKeyStream(dst, src []byte) {
+	s.Stream.XORKeyStream(dst, src)
+	s.n.Add(uint64(len(src)))
+}
+
+// Close zeroes EncryptKey, DecryptKey, salts, and IVs in place, and drops
+// references to cipher streams, so key material doesn't linger in memory
+// until garbage collected. Close must be called only after the connection
+// using ed is done, and ed can't be used afterwards.
+//
+// Since keys are zeroed in place, a key slice shared with anything else
+// (e.g. another StreamEncryptDecrypter) is zeroed as well.
+func (ed *StreamEncryptDecrypter) Close() error {
+	for _, b := range [][]byte{
+		ed.EncryptKey, ed.DecryptKey,
+		ed.EncryptSalt, ed.DecryptSalt,
+		ed.EncryptIV, ed.DecryptIV,
+		ed.encryptMACKey, ed.decryptMACKey,
+		ed.encryptSubkey, ed.decryptSubkey,
+	} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+
+	ed.EncryptStream = nil
+	ed.DecryptStream = nil
+
+	return nil
 }
 
-func (ed *StreamEncryptDecrypter) initCipherStream() error {
+// initEncryptStream initializes EncryptStream, and returns a header that must
+// be sent to the peer ahead of the ciphertext.
+func (ed *StreamEncryptDecrypter) initEncryptStream() ([]byte, error) {
+	var header []byte
+
 	if ed.EncryptStream == nil {
-		if ed.StreamEncrypter == nil || ed.EncryptKey == nil {
-			return errors.New("at least one of EncryptStream OR EncryptKey and StreamEncrypter must be set")
+		if (ed.StreamEncrypter == nil && ed.StreamFactory == nil) || ed.EncryptKey == nil {
+			return nil, fmt.Errorf("%w: at least one of EncryptStream OR EncryptKey and StreamEncrypter must be set", ErrMissingEncryptKey)
+		}
+
+		if err := ed.checkKey("encrypt", ed.EncryptKey); err != nil {
+			return nil, err
+		}
+
+		if err := ed.checkModes(); err != nil {
+			return nil, err
+		}
+
+		if ed.NegotiateIV {
+			ivSize, err := ed.ivSize(ed.EncryptKey)
+			if err != nil {
+				return nil, err
+			}
+
+			ed.EncryptIV = make([]byte, ivSize)
+			if _, err := io.ReadFull(rand.Reader, ed.EncryptIV); err != nil {
+				return nil, err
+			}
 		}
 
 		if ed.EncryptIV == nil {
-			return errors.New("encrypt IV must be set")
+			return nil, fmt.Errorf("%w: encrypt IV must be set", ErrMissingIV)
+		}
+
+		key := ed.EncryptKey
+		if ed.Salted {
+			if ed.EncryptSalt == nil {
+				ed.EncryptSalt = make([]byte, SaltSize)
+				if _, err := io.ReadFull(rand.Reader, ed.EncryptSalt); err != nil {
+					return nil, err
+				}
+			}
+			header = append(header, ed.EncryptSalt...)
+
+			var err error
+			if key, err = DeriveSubkey(key, ed.EncryptSalt, len(key)); err != nil {
+				return nil, err
+			}
+		}
+
+		if ed.NegotiateIV {
+			header = append(header, ed.EncryptIV...)
+		}
+
+		if ed.Authenticated {
+			var err error
+			if ed.encryptMACKey, err = deriveKey(ed.EncryptKey, ed.EncryptSalt, "groundhog-mac", MACSize); err != nil {
+				return nil, err
+			}
 		}
 
-		block, err := aes.NewCipher(ed.EncryptKey)
+		if ed.Authenticated {
+			// kept apart from EncryptKey, since it's ratcheted on rekey
+			ed.encryptSubkey = append([]byte(nil), key...)
+		}
+
+		if ed.IVCache != nil {
+			if err := ed.IVCache.add("encrypt", key, ed.EncryptIV); err != nil {
+				return nil, err
+			}
+		}
+
+		stream, err := ed.newStream("encrypt", key, ed.EncryptIV, ed.StreamEncrypter)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		ed.EncryptStream = stream
+	}
+
+	if ed.rekeyEnabled() {
+		if !ed.Authenticated {
+			return nil, errors.New("rekeying requires Authenticated")
+		}
+		if ed.encryptSubkey == nil {
+			return nil, errors.New("rekeying requires EncryptKey rather than EncryptStream")
+		}
+	}
+
+	return header, nil
+}
+
+// decryptHeaderLen returns length of the header expected from the peer ahead
+// of the ciphertext.
+func (ed *StreamEncryptDecrypter) decryptHeaderLen() (int, error) {
+	if ed.DecryptStream != nil {
+		return 0, nil
+	}
+
+	n := 0
+	if ed.Salted {
+		n += SaltSize
+	}
+
+	if ed.NegotiateIV {
+		ivSize, err := ed.ivSize(ed.DecryptKey)
+		if err != nil {
+			return 0, err
 		}
-		ed.EncryptStream = ed.StreamEncrypter(block, ed.EncryptIV)
+		n += ivSize
 	}
 
+	return n, nil
+}
+
+// ivSize returns length of IVs generated by NegotiateIV.
+func (ed *StreamEncryptDecrypter) ivSize(key []byte) (int, error) {
+	if ed.IVSize > 0 {
+		return ed.IVSize, nil
+	}
+
+	if ed.StreamFactory != nil {
+		return 0, fmt.Errorf("%w: IVSize must be set to negotiate IV with StreamFactory", ErrMissingIVSize)
+	}
+
+	block, err := ed.newBlock(key)
+	if err != nil {
+		return 0, err
+	}
+	return block.BlockSize(), nil
+}
+
+// initDecryptStream initializes DecryptStream with a header received from the
+// peer.
+func (ed *StreamEncryptDecrypter) initDecryptStream(header []byte) error {
 	if ed.DecryptStream == nil {
-		if ed.StreamDecrypter == nil || ed.DecryptKey == nil {
-			return errors.New("at least one of DecryptStream OR DecryptKey and StreamDecrypter must be set")
+		if (ed.StreamDecrypter == nil && ed.StreamFactory == nil) || ed.DecryptKey == nil {
+			return fmt.Errorf("%w: at least one of DecryptStream OR DecryptKey and StreamDecrypter must be set", ErrMissingDecryptKey)
+		}
+
+		if err := ed.checkKey("decrypt", ed.DecryptKey); err != nil {
+			return err
+		}
+
+		if err := ed.checkModes(); err != nil {
+			return err
+		}
+
+		key := ed.DecryptKey
+		if ed.Salted {
+			ed.DecryptSalt, header = header[:SaltSize], header[SaltSize:]
+
+			var err error
+			if key, err = DeriveSubkey(key, ed.DecryptSalt, len(key)); err != nil {
+				return err
+			}
+		}
+
+		if ed.NegotiateIV {
+			ed.DecryptIV = header
+		}
+
+		if ed.Authenticated {
+			var err error
+			if ed.decryptMACKey, err = deriveKey(ed.DecryptKey, ed.DecryptSalt, "groundhog-mac", MACSize); err != nil {
+				return err
+			}
 		}
 
 		if ed.DecryptIV == nil {
-			return errors.New("decrypt IV must be set")
+			return fmt.Errorf("%w: decrypt IV must be set", ErrMissingIV)
 		}
 
-		block, err := aes.NewCipher(ed.DecryptKey)
+		if ed.Authenticated {
+			ed.decryptSubkey = append([]byte(nil), key...)
+		}
+
+		if ed.IVCache != nil {
+			if err := ed.IVCache.add("decrypt", key, ed.DecryptIV); err != nil {
+				return err
+			}
+		}
+
+		stream, err := ed.newStream("decrypt", key, ed.DecryptIV, ed.StreamDecrypter)
 		if err != nil {
 			return err
 		}
-		ed.DecryptStream = ed.StreamDecrypter(block, ed.DecryptIV)
+		ed.DecryptStream = stream
 	}
 
 	return nil
 }
 
+// checkKey validates length of an AES key, so a bad key is reported against
+// the field it came from. Keys for custom BlockFactory or StreamFactory are
+// left to the factory to validate.
+func (ed *StreamEncryptDecrypter) checkKey(direction string, key []byte) error {
+	if ed.BlockFactory != nil || ed.StreamFactory != nil {
+		return nil
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s key must be 16, 24, or 32 bytes, got %d", ErrInvalidKeySize, direction, len(key))
+	}
+}
+
+// newStream returns a cipher stream of mode keyed with key and iv, for
+// direction, i.e. "encrypt" or "decrypt". iv must be as long as the block size
+// of the cipher, or an error naming both lengths is returned, rather than
+// letting mode panic. IVs for StreamFactory are left to it to validate.
+func (ed *StreamEncryptDecrypter) newStream(direction string, key, iv []byte, mode func(block cipher.Block, iv []byte) cipher.Stream) (cipher.Stream, error) {
+	if ed.StreamFactory != nil {
+		return ed.StreamFactory(key, iv)
+	}
+
+	block, err := ed.newBlock(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("%w: %s IV must be %d bytes, the block size of the cipher, got %d", ErrInvalidIVSize, direction, block.BlockSize(), len(iv))
+	}
+	return mode(block, iv), nil
+}
+
+func (ed *StreamEncryptDecrypter) newBlock(key []byte) (cipher.Block, error) {
+	if ed.BlockFactory != nil {
+		return ed.BlockFactory(key)
+	}
+	return aes.NewCipher(key)
+}
+
+// NewChaCha20Stream is a StreamFactory backed by ChaCha20. key must be 32 bytes
+// long, and iv is used as a 12-byte nonce.
+func NewChaCha20Stream(key, iv []byte) (cipher.Stream, error) {
+	if len(key) != chacha20.KeySize {
+		return nil, fmt.Errorf("%w: chacha20 key must be %d bytes, got %d", ErrInvalidKeySize, chacha20.KeySize, len(key))
+	}
+
+	if len(iv) != chacha20.NonceSize {
+		return nil, fmt.Errorf("%w: chacha20 nonce must be %d bytes, got %d", ErrInvalidIVSize, chacha20.NonceSize, len(iv))
+	}
+
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
 // Ciphertext takes a duplex io.ReadWriter with plaintext, encrypt and return a
 // corresponding ciphertext io.ReadWriter. Any ciphertext write to returned
 // io.ReadWriter will be decrypted and write to plaintext. Any plaintext read
 // from plaintext will be encrypted and write to returned io.ReadWriter.
+//
+// Where decryption needs whole frames (i.e. Authenticated or Compress is set),
+// written ciphertext goes through an in-memory pipe to a goroutine, which lives
+// until the returned net.Conn is closed. Prefer NewCipherConn where possible.
 func (ed *StreamEncryptDecrypter) Ciphertext(plaintext net.Conn) (net.Conn, error) {
-	if err := ed.initCipherStream(); err != nil {
+	if ed.PassThrough {
+		return newPassThroughConn(plaintext), nil
+	}
+
+	header, err := ed.initEncryptStream()
+	if err != nil {
 		return nil, err
 	}
 
-	return &CipherConn{
-		&readWriter{
-			&cipher.StreamReader{S: ed.EncryptStream, R: plaintext},
-			&cipher.StreamWriter{S: ed.DecryptStream, W: plaintext},
-		},
-		plaintext,
-	}, nil
+	n, err := ed.decryptHeaderLen()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &CipherConn{Conn: plaintext, mode: ed.mode, keyLen: ed.KeyLen()}
+	rw := &readWriter{}
+
+	// plaintext to encrypt is read from src, and decrypted plaintext is
+	// written to dst
+	var src io.Reader = plaintext
+	var dst io.Writer = plaintext
+	if ed.Compress {
+		src = newCompressingReader(plaintext)
+		pipe := newPipeWriter(plaintext, newDecompressingReader, conn.fail)
+		rw.pipes = append(rw.pipes, pipe)
+		dst = pipe
+	}
+
+	if ed.Authenticated {
+		rw.Reader = &sealingReader{r: src, sealer: ed.newMACSealer()}
+		pipe := newOpeningWriter(dst, ed.newMACOpener(n), conn.fail)
+		rw.pipes = append(rw.pipes, pipe)
+		rw.Writer = pipe
+	} else {
+		rw.Reader = &cipher.StreamReader{S: ed.encrypter(), R: src}
+		if n > 0 {
+			rw.Writer = &headerStripper{n: n, init: func(header []byte) (io.Writer, error) {
+				if err := ed.initDecryptStream(header); err != nil {
+					return nil, err
+				}
+				return &cipher.StreamWriter{S: ed.decrypter(), W: dst}, nil
+			}}
+		} else {
+			if err := ed.initDecryptStream(nil); err != nil {
+				return nil, err
+			}
+			rw.Writer = &cipher.StreamWriter{S: ed.decrypter(), W: dst}
+		}
+	}
+
+	if len(header) > 0 {
+		rw.Reader = io.MultiReader(bytes.NewReader(header), rw.Reader)
+	}
+
+	conn.ReadWriter = rw
+	return conn, nil
 }
 
 // Plaintext takes a duplex io.ReadWriter with ciphertext, decrypt and return a
@@ -88,35 +534,421 @@ func (ed *StreamEncryptDecrypter) Ciphertext(plaintext net.Conn) (net.Conn, erro
 // io.ReadWriter will be encrypted and write to ciphertext. Any ciphertext read
 // from ciphertext will be decrypted and write to returned io.ReadWriter.
 func (ed *StreamEncryptDecrypter) Plaintext(ciphertext net.Conn) (net.Conn, error) {
-	if err := ed.initCipherStream(); err != nil {
+	conn, err := NewCipherConn(ciphertext, ed)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewCipherConn wraps ciphertext into a CipherConn whose
+// Read decrypts and Write encrypts. Both are done synchronously on the calling
+// goroutine, with no internal pipe or goroutine per connection.
+func NewCipherConn(ciphertext net.Conn, ed *StreamEncryptDecrypter) (*CipherConn, error) {
+	if ed.PassThrough {
+		return newPassThroughConn(ciphertext), nil
+	}
+
+	header, err := ed.initEncryptStream()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := ed.decryptHeaderLen()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &CipherConn{Conn: ciphertext, mode: ed.mode, keyLen: ed.KeyLen()}
+	rw := &readWriter{}
+
+	if ed.Authenticated {
+		rw.Reader = &chunkReader{r: ciphertext, opener: ed.newMACOpener(n), fail: conn.fail}
+		rw.Writer = &chunkWriter{w: ciphertext, sealer: ed.newMACSealer()}
+	} else {
+		if n > 0 {
+			rw.Reader = &headerReader{r: ciphertext, n: n, init: func(header []byte) (io.Reader, error) {
+				if err := ed.initDecryptStream(header); err != nil {
+					return nil, err
+				}
+				return &cipher.StreamReader{S: ed.decrypter(), R: ciphertext}, nil
+			}}
+		} else {
+			if err := ed.initDecryptStream(nil); err != nil {
+				return nil, err
+			}
+			rw.Reader = &cipher.StreamReader{S: ed.decrypter(), R: ciphertext}
+		}
+		rw.Writer = &cipher.StreamWriter{S: ed.encrypter(), W: ciphertext}
+	}
+
+	if len(header) > 0 {
+		rw.Writer = &headerWriter{w: ciphertext, header: header, next: rw.Writer}
+	}
+
+	if ed.Compress {
+		rw.Reader = newDecompressingReader(rw.Reader)
+		rw.Writer = newCompressingWriter(rw.Writer)
+	}
+
+	conn.ReadWriter = rw
+	return conn, nil
+}
+
+// newPassThroughConn wraps conn into a CipherConn reading from and writing to
+// conn as is, see StreamEncryptDecrypter.PassThrough.
+func newPassThroughConn(conn net.Conn) *CipherConn {
+	return &CipherConn{Conn: conn, ReadWriter: &readWriter{Reader: conn, Writer: conn}}
+}
+
+// CiphertextContext is like Ciphertext, but the returned net.Conn is closed
+// once ctx is done, after which Read and Write return ctx.Err().
+func (ed *StreamEncryptDecrypter) CiphertextContext(ctx context.Context, plaintext net.Conn) (net.Conn, error) {
+	conn, err := ed.Ciphertext(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.(*CipherConn).watch(ctx)
+	return conn, nil
+}
+
+// PlaintextContext is like Plaintext, but the returned net.Conn is closed once
+// ctx is done, after which Read and Write return ctx.Err().
+func (ed *StreamEncryptDecrypter) PlaintextContext(ctx context.Context, ciphertext net.Conn) (net.Conn, error) {
+	conn, err := ed.Plaintext(ciphertext)
+	if err != nil {
 		return nil, err
 	}
 
-	return &CipherConn{
-		&readWriter{
-			&cipher.StreamReader{S: ed.DecryptStream, R: ciphertext},
-			&cipher.StreamWriter{S: ed.EncryptStream, W: ciphertext},
-		},
-		ciphertext,
-	}, nil
+	conn.(*CipherConn).watch(ctx)
+	return conn, nil
 }
 
 // CipherConn implements net.Conn interface, with a underlying io.ReadWriter.
+//
+// The underlying net.Conn can be any net.Conn, e.g. a *tls.Conn, to run the
+// encrypted stream inside TLS. Empty reads and writes are not passed on to
+// it, and CloseWrite is passed on if it has a CloseWrite method.
+//
+// Reads and writes go straight to the underlying io.ReadWriter, which reads
+// from and writes to the underlying net.Conn. Errors from net.Conn, including
+// io.EOF once the peer closes the connection, are returned as is.
+//
+// Deadlines set on CipherConn apply to both the underlying net.Conn and any
+// in-memory pipe sitting between a Write and the underlying net.Conn.
+//
+// Once an error other than io.EOF or a timeout occurs, including one from a background
+// goroutine, it is recorded, and returned by all subsequent failing Read and
+// Write calls, so a crypto failure can be told apart from a clean close.
 type CipherConn struct {
 	io.ReadWriter
 	net.Conn
+
+	mu     sync.Mutex
+	err    error
+	closed chan struct{}
+	done   atomic.Bool // set by Close, before anything is closed
+
+	// of the EncryptDecrypter c is made by, never changed afterwards
+	mode   CipherMode
+	keyLen int
 }
 
 func (c *CipherConn) Read(b []byte) (n int, err error) {
-	if _, err := c.Conn.Read([]byte{}); err != nil {
-		return 0, err
+	if c.done.Load() {
+		// not left to the underlying io.ReadWriter, which may have buffered
+		// data, e.g. a header, to return without any I/O
+		return 0, c.errClosed("read")
+	}
+	if len(b) == 0 {
+		// not passed on, as e.g. *tls.Conn would block on a handshake
+		return 0, nil
 	}
-	return c.ReadWriter.Read(b)
+
+	n, err = c.ReadWriter.Read(b)
+	return n, c.record(c.closedErr("read", err))
 }
 
 func (c *CipherConn) Write(b []byte) (n int, err error) {
-	if _, err := c.Conn.Write([]byte{}); err != nil {
-		return 0, err
+	if c.done.Load() {
+		return 0, c.errClosed("write")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	n, err = c.ReadWriter.Write(b)
+	return n, c.record(c.closedErr("write", err))
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy into c encrypts in place.
+// Where c encrypts with a bare cipher stream, i.e. neither Authenticated nor
+// Compress is set, data read from r is encrypted in the buffer it's read into,
+// and written straight to the underlying net.Conn, instead of being copied
+// once more by every Write. Otherwise, it's the same as io.Copy with Write.
+func (c *CipherConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if c.done.Load() {
+		return 0, c.errClosed("write")
+	}
+
+	var hw *headerWriter
+	var w io.Writer = c.ReadWriter
+	if rw, ok := w.(*readWriter); ok {
+		w = rw.Writer
+	}
+	if h, ok := w.(*headerWriter); ok {
+		hw, w = h, h.next
+	}
+
+	sw, ok := w.(*cipher.StreamWriter)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	for {
+		nr, rerr := r.Read(*buf)
+		if nr > 0 {
+			if hw != nil {
+				if err := hw.writeHeader(); err != nil {
+					return n, c.record(c.closedErr("write", err))
+				}
+			}
+
+			b := (*buf)[:nr]
+			sw.S.XORKeyStream(b, b)
+			nw, werr := sw.W.Write(b)
+			n += int64(nw)
+			if werr == nil && nw < nr {
+				// the key stream is out of step with the peer now
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return n, c.record(c.closedErr("write", werr))
+			}
+		}
+
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, so that io.Copy out of c decrypts in place.
+// Where c decrypts with a bare cipher stream, data read from the underlying
+// net.Conn is decrypted in the buffer it's read into, and written straight to
+// w, without a buffer of io.Copy in between. Otherwise, it's the same as
+// io.Copy with Read.
+func (c *CipherConn) WriteTo(w io.Writer) (n int64, err error) {
+	if c.done.Load() {
+		return 0, c.errClosed("read")
+	}
+
+	var r io.Reader = c.ReadWriter
+	if rw, ok := r.(*readWriter); ok {
+		r = rw.Reader
+	}
+	if hr, ok := r.(*headerReader); ok {
+		if err := hr.readHeader(); err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, c.record(c.closedErr("read", err))
+		}
+		r = hr.next
+	}
+
+	sr, ok := r.(*cipher.StreamReader)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{c})
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	for {
+		nr, rerr := sr.R.Read(*buf)
+		if nr > 0 {
+			b := (*buf)[:nr]
+			sr.S.XORKeyStream(b, b)
+			nw, werr := w.Write(b)
+			n += int64(nw)
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return n, werr
+			}
+		}
+
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, c.record(c.closedErr("read", rerr))
+		}
+	}
+}
+
+// closedErr translates io.ErrClosedPipe from an in-memory pipe, closed along
+// with c or after the peer hung up, into what a closed net.Conn returns, i.e.
+// a *net.OpError wrapping net.ErrClosed, so that callers can check for it as
+// with any net.Conn.
+func (c *CipherConn) closedErr(op string, err error) error {
+	if !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	return c.errClosed(op)
+}
+
+// errClosed returns the error of op on a closed net.Conn.
+func (c *CipherConn) errClosed(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.LocalAddr().Network(),
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    net.ErrClosed,
+	}
+}
+
+// Mode returns the CipherMode of the StreamEncryptDecrypter c is made by, or 0
+// if unknown, e.g. c is made by AEADEncryptDecrypter.
+func (c *CipherConn) Mode() CipherMode {
+	return c.mode
+}
+
+// KeyLen returns length in bytes of the key c encrypts with, e.g. 32 for
+// AES-256, or 0 if unknown.
+func (c *CipherConn) KeyLen() int {
+	return c.keyLen
+}
+
+// Err returns the first error other than io.EOF encountered by c, or nil if
+// there is none.
+func (c *CipherConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// record records err if it's the first error other than io.EOF or a timeout,
+// and returns the first recorded error in place of err.
+func (c *CipherConn) record(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// deadline exceeded, c is still usable after deadline is extended
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// SetDeadline implements SetDeadline in net.Conn interface.
+func (c *CipherConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements SetReadDeadline in net.Conn interface.
+func (c *CipherConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements SetWriteDeadline in net.Conn interface.
+func (c *CipherConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriter.(writeDeadliner); ok {
+		if err := d.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// watch fails c with ctx.Err() once ctx is done, unless c is closed first.
+func (c *CipherConn) watch(ctx context.Context) {
+	closed := c.closedChan()
+
+	// watchdog to close connection if context cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.fail(ctx.Err())
+		case <-closed:
+		}
+	}()
+}
+
+func (c *CipherConn) closedChan() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
+}
+
+// fail records err and closes the underlying net.Conn.
+func (c *CipherConn) fail(err error) {
+	c.record(err)
+	c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the underlying net.Conn, once
+// everything written to c has been written to it, so that the peer reads
+// io.EOF after the last of it. The underlying net.Conn must have a CloseWrite
+// method, as *net.TCPConn and *tls.Conn do, or util.ErrHalfCloseUnsupported
+// is returned.
+func (c *CipherConn) CloseWrite() error {
+	if rw, ok := c.ReadWriter.(*readWriter); ok {
+		// pipes are drained in the order data flows through them, i.e. the
+		// one written to first
+		for i := len(rw.pipes) - 1; i >= 0; i-- {
+			if err := rw.pipes[i].closeWrite(); err != nil {
+				return c.record(err)
+			}
+		}
+	}
+	return util.CloseWrite(c.Conn)
+}
+
+// Close closes the underlying io.ReadWriter, if it can be closed, and the
+// underlying net.Conn. Read and Write return net.ErrClosed afterwards.
+func (c *CipherConn) Close() error {
+	c.done.Store(true)
+
+	c.mu.Lock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	c.mu.Unlock()
+
+	if closer, ok := c.ReadWriter.(io.Closer); ok {
+		closer.Close()
 	}
-	return c.ReadWriter.Write(b)
+	return c.Conn.Close()
 }
@@ -0,0 +1,556 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+// newTestStream returns a StreamEncryptDecrypter of AES-256 in mode, as of
+// NewStreamEncryptDecrypter, failing t on error.
+func newTestStream(t testing.TB, mode CipherMode) *StreamEncryptDecrypter {
+	t.Helper()
+
+	ed, err := NewStreamEncryptDecrypter(testKey, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed
+}
+
+var roundTripTests = []struct {
+	name string
+	new  func(t testing.TB) EncryptDecrypter
+}{
+	{"cfb", func(t testing.TB) EncryptDecrypter { return newTestStream(t, CFB) }},
+	{"ctr", func(t testing.TB) EncryptDecrypter { return newTestStream(t, CTR) }},
+	{"ofb", func(t testing.TB) EncryptDecrypter { return newTestStream(t, OFB) }},
+	{"chacha20", func(t testing.TB) EncryptDecrypter {
+		return &StreamEncryptDecrypter{
+			EncryptKey:    append([]byte(nil), testKey...),
+			DecryptKey:    append([]byte(nil), testKey...),
+			StreamFactory: NewChaCha20Stream,
+			NegotiateIV:   true,
+			IVSize:        12,
+		}
+	}},
+	{"aead", func(t testing.TB) EncryptDecrypter {
+		return &AEADEncryptDecrypter{
+			EncryptKey: append([]byte(nil), testKey...),
+			DecryptKey: append([]byte(nil), testKey...),
+			AEAD:       NewAESGCM,
+		}
+	}},
+	{"authenticated+compress", func(t testing.TB) EncryptDecrypter {
+		ed := newTestStream(t, CTR)
+		ed.Authenticated = true
+		ed.Compress = true
+		return ed
+	}},
+}
+
+func TestPipeRoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("groundhog "), 10000)
+
+	for _, tt := range roundTripTests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote, err := Pipe(tt.new(t), tt.new(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+			defer remote.Close()
+
+			// both directions, one after another, as net.Pipe is synchronous
+			for _, p := range [][2]io.ReadWriter{{local, remote}, {remote, local}} {
+				errc := make(chan error, 1)
+				go func(w io.Writer) {
+					_, err := w.Write(msg)
+					errc <- err
+				}(p[0])
+
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(p[1], got); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatal("plaintext read differs from plaintext written")
+				}
+			}
+		})
+	}
+}
+
+func TestCipherConnReadDeadline(t *testing.T) {
+	lhs, rhs := net.Pipe()
+	defer rhs.Close()
+
+	conn, err := newTestStream(t, CTR).Plaintext(lhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read past deadline returned %v, want a timeout net.Error", err)
+	}
+	if err := conn.(*CipherConn).Err(); err != nil {
+		t.Fatalf("timeout recorded as %v", err)
+	}
+}
+
+// BenchmarkCiphertext measures a short-lived connection through Ciphertext
+// with Authenticated, whose decoding goroutine copies with a BufferSize
+// buffer. "unpooled" changes BufferSize between connections, so every
+// connection allocates its buffer, as it did before bufferPool.
+func BenchmarkCiphertext(b *testing.B) {
+	for _, pooled := range []bool{true, false} {
+		name := "pooled"
+		if !pooled {
+			name = "unpooled"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			defer func(size int) { BufferSize = size }(BufferSize)
+
+			ed := newTestStream(b, CTR)
+			ed.Authenticated = true
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !pooled {
+					BufferSize = 32*1024 + i%2
+				}
+
+				lhs, rhs := net.Pipe()
+				conn, err := ed.Ciphertext(lhs)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// waits for the decoding goroutine to return its buffer
+				conn.(*CipherConn).CloseWrite()
+				conn.Close()
+				rhs.Close()
+			}
+		})
+	}
+}
+
+func TestStreamEncryptDecrypterClose(t *testing.T) {
+	ed, peer := newTestStream(t, CTR), newTestStream(t, CTR)
+	ed.Authenticated, peer.Authenticated = true, true
+
+	local, remote, err := Pipe(ed, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+	remote.Close()
+
+	secrets := [][]byte{
+		ed.EncryptKey, ed.DecryptKey,
+		ed.EncryptSalt, ed.EncryptIV,
+		ed.encryptMACKey, ed.encryptSubkey,
+	}
+
+	if err := ed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, b := range secrets {
+		if len(b) == 0 {
+			t.Fatalf("secret %d not set before Close", i)
+		}
+		if !bytes.Equal(b, make([]byte, len(b))) {
+			t.Errorf("secret %d not zeroed by Close: %x", i, b)
+		}
+	}
+	if ed.EncryptStream != nil || ed.DecryptStream != nil {
+		t.Error("cipher streams still referenced after Close")
+	}
+}
+
+// BenchmarkNewCipherConn measures setting up and tearing down an Authenticated
+// connection with NewCipherConn, against the in-memory pipe Ciphertext (and
+// Plaintext, before NewCipherConn) decodes frames through.
+func BenchmarkNewCipherConn(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		new  func(ed *StreamEncryptDecrypter, conn net.Conn) (net.Conn, error)
+	}{
+		{"synchronous", func(ed *StreamEncryptDecrypter, conn net.Conn) (net.Conn, error) {
+			return NewCipherConn(conn, ed)
+		}},
+		{"piped", (*StreamEncryptDecrypter).Ciphertext},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			goroutines := 0
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ed := newTestStream(b, CTR)
+				ed.Authenticated = true
+
+				lhs, rhs := net.Pipe()
+				before := runtime.NumGoroutine()
+				conn, err := bm.new(ed, lhs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				goroutines += runtime.NumGoroutine() - before
+
+				conn.(*CipherConn).CloseWrite()
+				conn.Close()
+				rhs.Close()
+			}
+			b.ReportMetric(float64(goroutines)/float64(b.N), "goroutines/conn")
+		})
+	}
+}
+
+func TestCipherConnClosed(t *testing.T) {
+	for _, tt := range roundTripTests {
+		for _, side := range []struct {
+			name string
+			new  func(ed EncryptDecrypter, conn net.Conn) (net.Conn, error)
+		}{
+			{"plaintext", EncryptDecrypter.Plaintext},
+			{"ciphertext", EncryptDecrypter.Ciphertext},
+		} {
+			t.Run(tt.name+"/"+side.name, func(t *testing.T) {
+				lhs, rhs := net.Pipe()
+				defer rhs.Close()
+
+				conn, err := side.new(tt.new(t), lhs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := conn.Write([]byte("groundhog")); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("Write after Close returned %v, want %v", err, net.ErrClosed)
+				}
+				if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("Read after Close returned %v, want %v", err, net.ErrClosed)
+				}
+				// even with nothing to copy
+				if _, err := conn.(io.ReaderFrom).ReadFrom(strings.NewReader("")); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("ReadFrom after Close returned %v, want %v", err, net.ErrClosed)
+				}
+				if _, err := conn.(io.WriterTo).WriteTo(io.Discard); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("WriteTo after Close returned %v, want %v", err, net.ErrClosed)
+				}
+			})
+		}
+
+		// the ciphertext side isn't covered, as writing arbitrary ciphertext
+		// fails on its own wherever it's authenticated
+		t.Run(tt.name+"/peer closed", func(t *testing.T) {
+			lhs, rhs := net.Pipe()
+			conn, err := tt.new(t).Plaintext(lhs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := rhs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				_, err := conn.Write(testBody)
+				errc <- err
+			}()
+			select {
+			case err := <-errc:
+				// io.ErrClosedPipe from the pipe, translated as on Close
+				if !errors.Is(err, net.ErrClosed) {
+					t.Fatalf("Write after peer closed returned %v, want %v", err, net.ErrClosed)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Write after peer closed blocked")
+			}
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn.(*net.TCPConn), peer.(*net.TCPConn)
+}
+
+// BenchmarkCipherConnCopy measures io.Copy of 1 MiB chunks between two
+// CipherConns over loopback TCP, with ReadFrom and WriteTo encrypting and
+// decrypting in place ("fast"), against the same copy through Write and Read
+// ("generic").
+func BenchmarkCipherConnCopy(b *testing.B) {
+	for _, fast := range []bool{true, false} {
+		name := "fast"
+		if !fast {
+			name = "generic"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			lhs, rhs := tcpPair(b)
+			local, err := newTestStream(b, CTR).Plaintext(lhs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer local.Close()
+			remote, err := newTestStream(b, CTR).Plaintext(rhs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer remote.Close()
+
+			// hides WriteTo and ReadFrom of CipherConn unless fast
+			var src io.Reader = remote
+			var dst io.Writer = local
+			if !fast {
+				src, dst = struct{ io.Reader }{remote}, struct{ io.Writer }{local}
+			}
+
+			done := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, src)
+				close(done)
+			}()
+
+			chunk := make([]byte, 1<<20)
+			b.SetBytes(int64(len(chunk)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// hides WriteTo of bytes.Reader, which io.Copy prefers
+				if _, err := io.Copy(dst, struct{ io.Reader }{bytes.NewReader(chunk)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			lhs.CloseWrite()
+			<-done
+		})
+	}
+}
+
+// noIOConn is a net.Conn counting reads and writes, which all fail.
+type noIOConn struct {
+	net.Conn
+	ops int
+}
+
+func (c *noIOConn) Read(b []byte) (int, error) {
+	c.ops++
+	return 0, io.ErrClosedPipe
+}
+
+func (c *noIOConn) Write(b []byte) (int, error) {
+	c.ops++
+	return 0, io.ErrClosedPipe
+}
+
+func (c *noIOConn) Close() error { return nil }
+
+func TestInvalidIVSize(t *testing.T) {
+	// 12 bytes is a GCM or ChaCha20 nonce, not an AES block
+	for _, n := range []int{12, 15, 17} {
+		for _, tt := range []struct {
+			name string
+			set  func(ed *StreamEncryptDecrypter)
+		}{
+			{"encrypt IV", func(ed *StreamEncryptDecrypter) { ed.EncryptIV = make([]byte, n) }},
+			{"decrypt IV", func(ed *StreamEncryptDecrypter) {
+				// otherwise, the decrypt stream waits for the salt of the peer
+				ed.Salted = false
+				ed.DecryptIV = make([]byte, n)
+			}},
+			{"negotiated IV", func(ed *StreamEncryptDecrypter) {
+				ed.NegotiateIV = true
+				ed.EncryptIV = nil
+				ed.IVSize = n
+			}},
+		} {
+			for _, side := range []struct {
+				name string
+				new  func(ed *StreamEncryptDecrypter, conn net.Conn) (net.Conn, error)
+			}{
+				{"plaintext", (*StreamEncryptDecrypter).Plaintext},
+				{"ciphertext", (*StreamEncryptDecrypter).Ciphertext},
+			} {
+				ed := newTestStream(t, CTR)
+				tt.set(ed)
+
+				conn := &noIOConn{}
+				if _, err := side.new(ed, conn); !errors.Is(err, ErrInvalidIVSize) {
+					t.Errorf("%d-byte %s, %s: error %v, want %v", n, tt.name, side.name, err, ErrInvalidIVSize)
+				}
+				if conn.ops != 0 {
+					t.Errorf("%d-byte %s, %s: %d reads and writes", n, tt.name, side.name, conn.ops)
+				}
+			}
+		}
+
+		ed := newTestStream(t, CTR)
+		ed.IVSize = n
+		if _, err := ed.EncryptPacket([]byte("groundhog")); !errors.Is(err, ErrInvalidIVSize) {
+			t.Errorf("%d-byte packet IV: error %v, want %v", n, err, ErrInvalidIVSize)
+		}
+	}
+}
+
+// tlsPair returns both ends of a loopback TLS connection, with a self-signed
+// certificate, before either end has handshaken.
+func tlsPair(t *testing.T) (*tls.Conn, *tls.Conn) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"groundhog.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	lhs, rhs := tcpPair(t)
+	return tls.Client(lhs, &tls.Config{InsecureSkipVerify: true}),
+		tls.Server(rhs, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func TestCipherConnOverTLS(t *testing.T) {
+	msg := bytes.Repeat([]byte("groundhog "), 20000)
+
+	for _, tt := range roundTripTests {
+		t.Run(tt.name, func(t *testing.T) {
+			lhs, rhs := tlsPair(t)
+
+			local, err := tt.new(t).Plaintext(lhs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+
+			// not passed on, or the TLS client would block on a handshake
+			// the server hasn't started yet
+			if n, err := local.Read(nil); n != 0 || err != nil {
+				t.Fatalf("empty Read returned %d, %v", n, err)
+			}
+			if n, err := local.Write(nil); n != 0 || err != nil {
+				t.Fatalf("empty Write returned %d, %v", n, err)
+			}
+
+			remote, err := tt.new(t).Plaintext(rhs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+
+			// each direction is half-closed in turn, the other still flowing
+			for _, p := range [][2]net.Conn{{local, remote}, {remote, local}} {
+				errc := make(chan error, 1)
+				go func(w net.Conn) {
+					if _, err := w.Write(msg); err != nil {
+						errc <- err
+						return
+					}
+					errc <- w.(*CipherConn).CloseWrite()
+				}(p[0])
+
+				got, err := io.ReadAll(p[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatal("plaintext read differs from plaintext written")
+				}
+			}
+		})
+	}
+}
+
+// readTampered encrypts msg with enc, flips the last byte of the ciphertext,
+// and returns the error of reading it back with dec.
+func readTampered(t *testing.T, enc, dec EncryptDecrypter, msg []byte) error {
+	t.Helper()
+
+	lhs, rhs := net.Pipe()
+	w, err := enc.Plaintext(lhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write(msg)
+		w.Close()
+	}()
+	ciphertext, err := io.ReadAll(rhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 1
+
+	lhs, rhs = net.Pipe()
+	r, err := dec.Plaintext(lhs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		rhs.Write(ciphertext)
+		rhs.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err == nil && !bytes.Equal(got, msg) {
+		t.Fatal("tampered plaintext read without an error")
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package crypto
+
+import "io"
+
+// headerWriter writes header to w ahead of the first write, then writes
+// everything to next.
+type headerWriter struct {
+	w      io.Writer
+	header []byte
+	next   io.Writer
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if err := hw.writeHeader(); err != nil {
+		return 0, err
+	}
+	return hw.next.Write(p)
+}
+
+// writeHeader writes header to w, unless it's written already.
+func (hw *headerWriter) writeHeader() error {
+	if hw.header != nil {
+		if _, err := hw.w.Write(hw.header); err != nil {
+			return err
+		}
+		hw.header = nil
+	}
+	return nil
+}
+
+// headerReader reads an n-byte header from r ahead of the first read, and
+// calls init with it to get the io.Reader for the rest of the stream.
+//
+// The header may arrive in pieces, and reading it may be interrupted, e.g. by
+// a deadline, so what's read of it is kept across calls, and init is never
+// called with a truncated header. If r ends before the whole header is read,
+// io.ErrUnexpectedEOF is returned.
+type headerReader struct {
+	r    io.Reader
+	n    int
+	init func(header []byte) (io.Reader, error)
+
+	header []byte
+	next   io.Reader
+}
+
+func (hr *headerReader) Read(p []byte) (int, error) {
+	if err := hr.readHeader(); err != nil {
+		return 0, err
+	}
+	return hr.next.Read(p)
+}
+
+// readHeader reads the header and sets next, unless it's done already.
+func (hr *headerReader) readHeader() error {
+	if hr.next != nil {
+		return nil
+	}
+
+	if hr.header == nil {
+		hr.header = make([]byte, 0, hr.n)
+	}
+
+	for len(hr.header) < hr.n {
+		m, err := hr.r.Read(hr.header[len(hr.header):hr.n])
+		hr.header = hr.header[:len(hr.header)+m]
+		if err == nil || len(hr.header) == hr.n {
+			continue
+		}
+
+		if err == io.EOF && len(hr.header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	next, err := hr.init(hr.header)
+	if err != nil {
+		return err
+	}
+	hr.next = next
+	return nil
+}
+
+// headerStripper takes an n-byte header from the beginning of everything
+// written to it, and calls init with it to get the io.Writer for the rest of
+// the stream.
+type headerStripper struct {
+	n    int
+	init func(header []byte) (io.Writer, error)
+
+	header []byte
+	next   io.Writer
+}
+
+func (hs *headerStripper) Write(p []byte) (int, error) {
+	if hs.next != nil {
+		return hs.next.Write(p)
+	}
+
+	written := hs.n - len(hs.header)
+	if len(p) < written {
+		written = len(p)
+	}
+	hs.header = append(hs.header, p[:written]...)
+	if len(hs.header) < hs.n {
+		return written, nil
+	}
+
+	next, err := hs.init(hs.header)
+	if err != nil {
+		return 0, err
+	}
+	hs.next = next
+
+	n, err := hs.next.Write(p[written:])
+	return written + n, err
+}
@@ -0,0 +1,188 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	testHeader = []byte("0123456789abcdef") // e.g. a 16-byte IV
+	testBody   = bytes.Repeat([]byte("groundhog "), 100)
+)
+
+// newTestHeaderReader returns a headerReader of testHeader from r, which
+// records the header init is called with in *header.
+func newTestHeaderReader(r io.Reader, header *[]byte) *headerReader {
+	return &headerReader{
+		r: r,
+		n: len(testHeader),
+		init: func(h []byte) (io.Reader, error) {
+			if *header != nil {
+				panic("init called twice")
+			}
+			*header = append([]byte(nil), h...)
+			return r, nil
+		},
+	}
+}
+
+func TestHeaderReader(t *testing.T) {
+	stream := append(append([]byte(nil), testHeader...), testBody...)
+
+	for _, tt := range []struct {
+		name string
+		r    func(io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"data and EOF", iotest.DataErrReader},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var header []byte
+			hr := newTestHeaderReader(tt.r(bytes.NewReader(stream)), &header)
+
+			body, err := io.ReadAll(hr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(header, testHeader) {
+				t.Fatalf("init called with %q, want %q", header, testHeader)
+			}
+			if !bytes.Equal(body, testBody) {
+				t.Fatal("body read differs from body written")
+			}
+		})
+	}
+}
+
+func TestHeaderReaderInterrupted(t *testing.T) {
+	stream := append(append([]byte(nil), testHeader...), testBody...)
+
+	// the second read, mid-header, fails as a deadline would
+	var header []byte
+	hr := newTestHeaderReader(iotest.TimeoutReader(iotest.HalfReader(bytes.NewReader(stream))), &header)
+
+	buf := make([]byte, len(stream))
+	if _, err := hr.Read(buf); err != iotest.ErrTimeout {
+		t.Fatalf("error %v, want %v", err, iotest.ErrTimeout)
+	}
+	if header != nil {
+		t.Fatalf("init called with truncated header %q", header)
+	}
+
+	body, err := io.ReadAll(hr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, testHeader) {
+		t.Fatalf("init called with %q, want %q", header, testHeader)
+	}
+	if !bytes.Equal(body, testBody) {
+		t.Fatal("body read differs from body written")
+	}
+}
+
+func TestHeaderReaderTruncated(t *testing.T) {
+	for n, want := range map[int]error{0: io.EOF, 1: io.ErrUnexpectedEOF, len(testHeader) - 1: io.ErrUnexpectedEOF} {
+		var header []byte
+		hr := newTestHeaderReader(iotest.OneByteReader(bytes.NewReader(testHeader[:n])), &header)
+
+		if _, err := hr.Read(make([]byte, 1)); err != want {
+			t.Fatalf("%d bytes: error %v, want %v", n, err, want)
+		}
+		if header != nil {
+			t.Fatalf("%d bytes: init called with truncated header %q", n, header)
+		}
+	}
+}
+
+func TestHeaderStripper(t *testing.T) {
+	stream := append(append([]byte(nil), testHeader...), testBody...)
+
+	for _, size := range []int{1, 7, len(testHeader), len(stream)} {
+		var header []byte
+		var body bytes.Buffer
+		hs := &headerStripper{
+			n: len(testHeader),
+			init: func(h []byte) (io.Writer, error) {
+				if header != nil {
+					panic("init called twice")
+				}
+				header = append([]byte(nil), h...)
+				return &body, nil
+			},
+		}
+
+		for p := stream; len(p) > 0; {
+			chunk := p[:min(size, len(p))]
+			n, err := hs.Write(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(chunk) {
+				t.Fatalf("%d-byte writes: wrote %d of %d bytes", size, n, len(chunk))
+			}
+			p = p[n:]
+		}
+
+		if !bytes.Equal(header, testHeader) {
+			t.Fatalf("%d-byte writes: init called with %q, want %q", size, header, testHeader)
+		}
+		if !bytes.Equal(body.Bytes(), testBody) {
+			t.Fatalf("%d-byte writes: body differs from body written", size)
+		}
+	}
+}
+
+// oneByteConn is a net.Conn reading a byte at a time.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+	return iotest.OneByteReader(c.Conn).Read(b)
+}
+
+func TestNegotiateIVOneByteReader(t *testing.T) {
+	// headers, e.g. IVs, sent ahead of the ciphertext arrive a byte at a time
+	for _, tt := range roundTripTests {
+		t.Run(tt.name, func(t *testing.T) {
+			lhs, rhs := net.Pipe()
+
+			local, err := tt.new(t).Plaintext(oneByteConn{lhs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+
+			remote, err := tt.new(t).Plaintext(oneByteConn{rhs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+
+			for _, p := range [][2]io.ReadWriter{{local, remote}, {remote, local}} {
+				errc := make(chan error, 1)
+				go func(w io.Writer) {
+					_, err := w.Write(testBody)
+					errc <- err
+				}(p[0])
+
+				got := make([]byte, len(testBody))
+				if _, err := io.ReadFull(p[1], got); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, testBody) {
+					t.Fatal("plaintext read differs from plaintext written")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/tabjy/groundhog/common/adt"
+)
+
+// ErrIVReuse is returned when a key and IV pair is about to be used a second
+// time, which would leak the XOR of two plaintexts.
+var ErrIVReuse = errors.New("key and IV pair has been used before")
+
+// IVCache remembers recently used key and IV pairs, as a safety net against a
+// broken random number generator or a replayed handshake. Only a digest of each
+// pair is kept. An IVCache may be shared by any number of
+// StreamEncryptDecrypter.
+type IVCache struct {
+	set adt.Set
+	mu  sync.Mutex
+}
+
+// NewIVCache returns an IVCache remembering up to size most recent pairs.
+func NewIVCache(size int) *IVCache {
+	return &IVCache{set: adt.NewLRUSet(size)}
+}
+
+// add records a key and IV pair used for direction, or returns ErrIVReuse if
+// it's been recorded already.
+func (c *IVCache) add(direction string, key, iv []byte) error {
+	h := sha256.New()
+	h.Write([]byte(direction))
+	h.Write(key)
+	h.Write(iv)
+
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.set.Contains(digest) {
+		return ErrIVReuse
+	}
+	c.set.Add(digest)
+	return nil
+}
@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SaltSize is the length of a salt generated for a salted
+// StreamEncryptDecrypter. 16 bytes of randomness makes it practically
+// impossible for two connections to end up with the same subkey.
+const SaltSize = 16
+
+// DeriveSubkey derives a keyLen-byte subkey from masterKey and salt with
+// HKDF-SHA256. A fresh random salt should be used for every connection, so
+// a long-lived master key never encrypts two streams with the same key.
+func DeriveSubkey(masterKey, salt []byte, keyLen int) ([]byte, error) {
+	return deriveKey(masterKey, salt, "groundhog-subkey", keyLen)
+}
+
+// deriveKey derives a keyLen-byte key with HKDF-SHA256. Keys derived with
+// different info are independent of each other.
+func deriveKey(secret, salt []byte, info string, keyLen int) ([]byte, error) {
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Password-based key derivation functions used by PasswordConfig.
+const (
+	KDFArgon2id byte = 0x00
+	KDFPBKDF2   byte = 0x01
+)
+
+// PasswordConfig defines how a human password is stretched into a key. The
+// zero value for PasswordConfig is a valid configuration, using Argon2id.
+//
+// Both ends of a tunnel must use identical PasswordConfig to end up with the
+// same key.
+type PasswordConfig struct {
+	KDF  byte   // KDFArgon2id or KDFPBKDF2.
+	Salt []byte // Salt for stretching. If nil, a fixed application salt would be used.
+
+	Time    uint32 // Argon2id number of passes. If 0, 1 would be used.
+	Memory  uint32 // Argon2id memory in KiB. If 0, 64 MiB would be used.
+	Threads uint8  // Argon2id parallelism. If 0, 4 would be used.
+
+	Iterations int // PBKDF2-SHA256 iterations. If 0, 600000 would be used.
+}
+
+// KeyFromPassword stretches password into a keyLen-byte key with Argon2id and
+// default parameters. keyLen must be 16, 24, or 32, matching AES-128, AES-192,
+// and AES-256 respectively.
+func KeyFromPassword(password string, keyLen int) ([]byte, error) {
+	return (&PasswordConfig{}).Key(password, keyLen)
+}
+
+// Key stretches password into a keyLen-byte key. keyLen must be 16, 24, or 32,
+// matching AES-128, AES-192, and AES-256 respectively.
+func (c *PasswordConfig) Key(password string, keyLen int) ([]byte, error) {
+	switch keyLen {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("key length must be 16, 24, or 32 bytes, got %d", keyLen)
+	}
+
+	salt := c.Salt
+	if salt == nil {
+		salt = []byte("groundhog-password-salt")
+	}
+
+	switch c.KDF {
+	case KDFArgon2id:
+		time, memory, threads := c.Time, c.Memory, c.Threads
+		if time == 0 {
+			time = 1
+		}
+		if memory == 0 {
+			memory = 64 * 1024
+		}
+		if threads == 0 {
+			threads = 4
+		}
+		return argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(keyLen)), nil
+	case KDFPBKDF2:
+		iter := c.Iterations
+		if iter == 0 {
+			iter = 600000
+		}
+		return pbkdf2.Key([]byte(password), salt, iter, keyLen, sha256.New), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %#x", c.KDF)
+	}
+}
+
+// KeysEqual reports whether keys a and b are identical, in constant time with
+// respect to their content. Secrets should always be compared with KeysEqual
+// rather than bytes.Equal, which leaks through timing how many leading bytes
+// match.
+func KeysEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// MACSize is the length of the HMAC-SHA256 tag appended to each chunk by an
+// Authenticated StreamEncryptDecrypter. Each chunk is framed as follows.
+//
+//	+----------+-----------+---------+
+//	| [LENGTH] | [PAYLOAD] |   TAG   |
+//	+----------+-----------+---------+
+//	|    2     | Variable  | MACSize |
+//	+----------+-----------+---------+
+//
+// LENGTH (a big-endian uint16 no larger than MaxChunkSize) and PAYLOAD are
+// encrypted by the cipher stream. TAG is computed over a 64-bit big-endian
+// chunk sequence number followed by the encrypted LENGTH and PAYLOAD, with a
+// MAC key derived separately from the encryption key.
+//
+// The most significant bit of LENGTH is set on the last chunk before the
+// sender rekeys (see StreamEncryptDecrypter.RekeyAfterBytes), and is not part
+// of the length.
+const MACSize = sha256.Size
+
+// rekeyFlag marks the last chunk under the current key. MaxChunkSize leaves the
+// top bits of LENGTH unused.
+const rekeyFlag = 0x8000
+
+func (ed *StreamEncryptDecrypter) newMACSealer() *macSealer {
+	s := &macSealer{
+		stream: ed.encrypter(),
+		mac:    hmac.New(sha256.New, ed.encryptMACKey),
+	}
+	if ed.rekeyEnabled() {
+		s.rekey = ed.rekeyEncryptStream
+		s.afterBytes = ed.RekeyAfterBytes
+		s.afterDuration = ed.RekeyAfterDuration
+		s.since = time.Now()
+	}
+	return s
+}
+
+// newMACOpener returns an opener reading an n-byte header ahead of the first
+// chunk.
+func (ed *StreamEncryptDecrypter) newMACOpener(n int) *macOpener {
+	return &macOpener{
+		init: func(r io.Reader) (cipher.Stream, hash.Hash, error) {
+			header := make([]byte, n)
+			if _, err := io.ReadFull(r, header); err != nil {
+				return nil, nil, err
+			}
+
+			if err := ed.initDecryptStream(header); err != nil {
+				return nil, nil, err
+			}
+			return ed.decrypter(), hmac.New(sha256.New, ed.decryptMACKey), nil
+		},
+		rekey: ed.rekeyDecryptStream,
+	}
+}
+
+type macSealer struct {
+	stream cipher.Stream
+	mac    hash.Hash
+	seq    uint64
+
+	// rekey, if set, returns a stream keyed with the next subkey.
+	rekey         func() (cipher.Stream, error)
+	afterBytes    uint64
+	afterDuration time.Duration
+	n             uint64    // bytes sealed since last rekey
+	since         time.Time // time of last rekey
+}
+
+func (s *macSealer) seal(dst, plaintext []byte) ([]byte, error) {
+	s.n += uint64(len(plaintext))
+	rekey := s.rekey != nil &&
+		(s.afterBytes > 0 && s.n >= s.afterBytes ||
+			s.afterDuration > 0 && time.Since(s.since) >= s.afterDuration)
+
+	length := len(plaintext)
+	if rekey {
+		length |= rekeyFlag
+	}
+
+	start := len(dst)
+	dst = append(dst, byte(length>>8), byte(length))
+	dst = append(dst, plaintext...)
+	s.stream.XORKeyStream(dst[start:], dst[start:])
+
+	s.mac.Reset()
+	binary.Write(s.mac, binary.BigEndian, s.seq)
+	s.mac.Write(dst[start:])
+	s.seq++
+	dst = s.mac.Sum(dst)
+
+	if rekey {
+		stream, err := s.rekey()
+		if err != nil {
+			return nil, err
+		}
+		s.stream = stream
+		s.n = 0
+		s.since = time.Now()
+	}
+
+	return dst, nil
+}
+
+type macOpener struct {
+	init  func(r io.Reader) (cipher.Stream, hash.Hash, error)
+	rekey func() (cipher.Stream, error)
+
+	stream cipher.Stream
+	mac    hash.Hash
+	seq    uint64
+}
+
+func (o *macOpener) open(r io.Reader) ([]byte, error) {
+	if o.stream == nil {
+		var err error
+		if o.stream, o.mac, err = o.init(r); err != nil {
+			return nil, err
+		}
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+
+	// length is decrypted ahead of verification, since it's needed to find the
+	// tag, but it's never released before the tag is verified
+	size := make([]byte, 2)
+	o.stream.XORKeyStream(size, length)
+	n := int(size[0])<<8 | int(size[1])
+	rekey := n&rekeyFlag != 0
+	n &^= rekeyFlag
+	if n > MaxChunkSize {
+		return nil, fmt.Errorf("chunk size %d exceeds maximum %d", n, MaxChunkSize)
+	}
+
+	buf := make([]byte, n+MACSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload, tag := buf[:len(buf)-MACSize], buf[len(buf)-MACSize:]
+
+	o.mac.Reset()
+	binary.Write(o.mac, binary.BigEndian, o.seq)
+	o.mac.Write(length)
+	o.mac.Write(payload)
+	if !hmac.Equal(tag, o.mac.Sum(nil)) {
+		return nil, fmt.Errorf("failed to verify chunk: %w", ErrAuthentication)
+	}
+	o.seq++
+
+	o.stream.XORKeyStream(payload, payload)
+
+	if rekey {
+		stream, err := o.rekey()
+		if err != nil {
+			return nil, err
+		}
+		o.stream = stream
+	}
+
+	return payload, nil
+}
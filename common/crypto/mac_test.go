@@ -0,0 +1,16 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthenticatedTampered(t *testing.T) {
+	enc, dec := newTestStream(t, CTR), newTestStream(t, CTR)
+	enc.Authenticated, dec.Authenticated = true, true
+
+	err := readTampered(t, enc, dec, []byte("groundhog"))
+	if !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("error %v, want %v", err, ErrAuthentication)
+	}
+}
@@ -0,0 +1,268 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CipherMode is a block cipher mode of operation, which turns a cipher.Block
+// into a cipher.Stream.
+type CipherMode byte
+
+// Built-in block cipher modes. More can be added with RegisterCipherMode.
+const (
+	CFB CipherMode = 0x01
+	CTR CipherMode = 0x02
+	OFB CipherMode = 0x03
+)
+
+type modeFuncs struct {
+	name string
+	enc  func(block cipher.Block, iv []byte) cipher.Stream
+	dec  func(block cipher.Block, iv []byte) cipher.Stream
+}
+
+var (
+	modesMu sync.RWMutex
+	modes   = map[CipherMode]modeFuncs{
+		CFB: {"cfb", cipher.NewCFBEncrypter, cipher.NewCFBDecrypter},
+		CTR: {"ctr", cipher.NewCTR, cipher.NewCTR},
+		OFB: {"ofb", cipher.NewOFB, cipher.NewOFB},
+	}
+)
+
+// RegisterCipherMode registers a block cipher mode with its encrypt and
+// decrypt stream constructors, and returns the CipherMode assigned to it.
+// Once registered, the mode can be looked up by name with ParseCipherMode and
+// ParseCipher. name is case-insensitive and must not be taken already.
+func RegisterCipherMode(name string, enc, dec func(block cipher.Block, iv []byte) cipher.Stream) (CipherMode, error) {
+	if enc == nil || dec == nil {
+		return 0, fmt.Errorf("both encrypter and decrypter must be set for cipher mode %s", name)
+	}
+
+	name = strings.ToLower(name)
+
+	modesMu.Lock()
+	defer modesMu.Unlock()
+
+	var next CipherMode
+	for m, f := range modes {
+		if f.name == name {
+			return 0, fmt.Errorf("cipher mode %s already registered", name)
+		}
+		if m > next {
+			next = m
+		}
+	}
+
+	if next == 0xff {
+		return 0, fmt.Errorf("too many cipher modes registered")
+	}
+	next++
+
+	modes[next] = modeFuncs{name, enc, dec}
+	return next, nil
+}
+
+// ParseCipherMode returns the CipherMode registered as name, e.g. "ctr".
+func ParseCipherMode(name string) (CipherMode, error) {
+	name = strings.ToLower(name)
+
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	for m, f := range modes {
+		if f.name == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported cipher mode %s", name)
+}
+
+// ParseCipher parses a cipher name in form of "aes-<bits>-<mode>", e.g.
+// "aes-256-ctr", and returns length of the key in bytes, and the CipherMode.
+func ParseCipher(name string) (keyLen int, mode CipherMode, err error) {
+	parts := strings.SplitN(strings.ToLower(name), "-", 3)
+	if len(parts) != 3 || parts[0] != "aes" {
+		return 0, 0, fmt.Errorf("unrecognized cipher %s", name)
+	}
+
+	bits, err := strconv.Atoi(parts[1])
+	if err != nil || (bits != 128 && bits != 192 && bits != 256) {
+		return 0, 0, fmt.Errorf("unrecognized cipher %s", name)
+	}
+
+	if mode, err = ParseCipherMode(parts[2]); err != nil {
+		return 0, 0, err
+	}
+
+	return bits / 8, mode, nil
+}
+
+// String implements String function of Stringer interface.
+func (m CipherMode) String() string {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	if f, ok := modes[m]; ok {
+		return f.name
+	}
+	return fmt.Sprintf("unknown cipher mode %#x", byte(m))
+}
+
+func (m CipherMode) streamFuncs() (enc, dec func(cipher.Block, []byte) cipher.Stream, err error) {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	f, ok := modes[m]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported cipher mode %#x", byte(m))
+	}
+	return f.enc, f.dec, nil
+}
+
+// NewStreamEncryptDecrypter returns a StreamEncryptDecrypter using AES in mode
+// with key for both directions, ready to be used by Ciphertext or Plaintext of
+// a single connection. key must be 16, 24, or 32 bytes long, selecting
+// AES-128, AES-192, or AES-256.
+//
+// Salted is enabled, so each connection encrypts with its own subkey, which
+// makes the all-zero IVs used in both directions safe. Both ends of a tunnel
+// must be constructed the same way.
+func NewStreamEncryptDecrypter(key []byte, mode CipherMode) (*StreamEncryptDecrypter, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("%w: key must be 16, 24, or 32 bytes, got %d", ErrInvalidKeySize, len(key))
+	}
+
+	enc, dec, err := mode.streamFuncs()
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are copied, so StreamEncryptDecrypter.Close never wipes key of the
+	// caller
+	return &StreamEncryptDecrypter{
+		EncryptKey:      append([]byte(nil), key...),
+		DecryptKey:      append([]byte(nil), key...),
+		StreamEncrypter: enc,
+		StreamDecrypter: dec,
+		EncryptIV:       make([]byte, aes.BlockSize),
+		DecryptIV:       make([]byte, aes.BlockSize),
+		Salted:          true,
+		mode:            mode,
+	}, nil
+}
+
+// Mode returns the CipherMode ed is made with by NewStreamEncryptDecrypter, or
+// set by SetMode, or 0 if unknown, i.e. ed is set up otherwise. It's safe for
+// concurrent use.
+func (ed *StreamEncryptDecrypter) Mode() CipherMode {
+	return ed.mode
+}
+
+// SetMode sets both StreamEncrypter and StreamDecrypter from mode, which is
+// the safe way to set them, as both directions then use the same mode.
+func (ed *StreamEncryptDecrypter) SetMode(mode CipherMode) error {
+	enc, dec, err := mode.streamFuncs()
+	if err != nil {
+		return err
+	}
+
+	ed.StreamEncrypter = enc
+	ed.StreamDecrypter = dec
+	ed.mode = mode
+	return nil
+}
+
+// checkModes returns ErrModeMismatch, wrapped with details, if StreamEncrypter
+// and StreamDecrypter are set separately to functions of registered cipher
+// modes which don't pair up, e.g. cipher.NewCFBEncrypter with cipher.NewCTR,
+// or cipher.NewCFBDecrypter as StreamEncrypter. Valid pairings are the
+// encrypter and decrypter of a single mode, i.e. for built-in modes,
+// cipher.NewCFBEncrypter with cipher.NewCFBDecrypter, cipher.NewCTR with
+// itself, and cipher.NewOFB with itself. Functions not registered with any
+// mode, e.g. closures, are left unchecked, as is everything if
+// AllowAsymmetricModes or StreamFactory is set.
+func (ed *StreamEncryptDecrypter) checkModes() error {
+	if ed.AllowAsymmetricModes || ed.StreamFactory != nil || ed.StreamEncrypter == nil || ed.StreamDecrypter == nil {
+		return nil
+	}
+
+	enc := reflect.ValueOf(ed.StreamEncrypter).Pointer()
+	dec := reflect.ValueOf(ed.StreamDecrypter).Pointer()
+
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	// the mode each function is an encrypter and a decrypter of, if any
+	var encAsEnc, encAsDec, decAsEnc, decAsDec string
+	for _, f := range modes {
+		fEnc := reflect.ValueOf(f.enc).Pointer()
+		fDec := reflect.ValueOf(f.dec).Pointer()
+		if fEnc == enc && fDec == dec {
+			return nil
+		}
+
+		if fEnc == enc {
+			encAsEnc = f.name
+		}
+		if fDec == enc {
+			encAsDec = f.name
+		}
+		if fEnc == dec {
+			decAsEnc = f.name
+		}
+		if fDec == dec {
+			decAsDec = f.name
+		}
+	}
+
+	switch {
+	case encAsEnc == "" && encAsDec != "":
+		return fmt.Errorf("%w: StreamEncrypter is the decrypter of cipher mode %s", ErrModeMismatch, encAsDec)
+	case decAsDec == "" && decAsEnc != "":
+		return fmt.Errorf("%w: StreamDecrypter is the encrypter of cipher mode %s", ErrModeMismatch, decAsEnc)
+	case encAsEnc != "" && decAsDec != "":
+		return fmt.Errorf("%w: StreamEncrypter is of cipher mode %s, but StreamDecrypter is of %s", ErrModeMismatch, encAsEnc, decAsDec)
+	}
+	return nil
+}
+
+// KeyLen returns length of EncryptKey in bytes, e.g. 32 for AES-256, or 0 if
+// EncryptKey is not set. It's safe for concurrent use.
+func (ed *StreamEncryptDecrypter) KeyLen() int {
+	return len(ed.EncryptKey)
+}
+
+// EncryptConn wraps conn, e.g. a connection across a tunnel, with AES in mode
+// with key, as of NewStreamEncryptDecrypter. Plaintext written to the
+// returned net.Conn is encrypted onto conn, and ciphertext read from conn is
+// decrypted. Both ends of a tunnel call EncryptConn with the same key and
+// mode.
+func EncryptConn(conn net.Conn, key []byte, mode CipherMode) (net.Conn, error) {
+	ed, err := NewStreamEncryptDecrypter(key, mode)
+	if err != nil {
+		return nil, err
+	}
+	return ed.Plaintext(conn)
+}
+
+// DecryptConn is the inverse of EncryptConn. It wraps conn carrying plaintext,
+// and the returned net.Conn carries ciphertext, as if read from and written to
+// a connection wrapped by EncryptConn, e.g. to bridge plaintext into an
+// encrypted tunnel without a network in between.
+func DecryptConn(conn net.Conn, key []byte, mode CipherMode) (net.Conn, error) {
+	ed, err := NewStreamEncryptDecrypter(key, mode)
+	if err != nil {
+		return nil, err
+	}
+	return ed.Ciphertext(conn)
+}
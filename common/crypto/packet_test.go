@@ -0,0 +1,21 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPacketTampered(t *testing.T) {
+	ed := newTestStream(t, CTR)
+	ed.Authenticated = true
+
+	packet, err := ed.EncryptPacket([]byte("groundhog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet[len(packet)-1] ^= 1
+
+	if _, err := ed.DecryptPacket(packet); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("error %v, want %v", err, ErrAuthentication)
+	}
+}
@@ -0,0 +1,30 @@
+package crypto
+
+import (
+	"net"
+)
+
+// Pipe returns both ends of a synchronous, in-memory, full duplex connection
+// as of net.Pipe, wrapped with Plaintext of local and remote respectively.
+// Plaintext written to one end is encrypted by one EncryptDecrypter, and
+// decrypted by the other before it's read from the other end, so that an
+// EncryptDecrypter can be exercised without a network, e.g. in tests.
+func Pipe(local, remote EncryptDecrypter) (net.Conn, net.Conn, error) {
+	lhs, rhs := net.Pipe()
+
+	localConn, err := local.Plaintext(lhs)
+	if err != nil {
+		lhs.Close()
+		rhs.Close()
+		return nil, nil, err
+	}
+
+	remoteConn, err := remote.Plaintext(rhs)
+	if err != nil {
+		localConn.Close()
+		rhs.Close()
+		return nil, nil, err
+	}
+
+	return localConn, remoteConn, nil
+}
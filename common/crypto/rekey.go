@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+func (ed *StreamEncryptDecrypter) rekeyEnabled() bool {
+	return ed.RekeyAfterBytes > 0 || ed.RekeyAfterDuration > 0
+}
+
+// rekeyEncryptStream ratchets the encrypt subkey forward, and replaces
+// EncryptStream with a stream keyed with it.
+func (ed *StreamEncryptDecrypter) rekeyEncryptStream() (cipher.Stream, error) {
+	key, err := ratchet(ed.encryptSubkey, ed.encryptGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := ed.newStream("encrypt", key, ed.EncryptIV, ed.StreamEncrypter)
+	if err != nil {
+		return nil, err
+	}
+
+	ed.encryptSubkey = key
+	ed.encryptGeneration++
+	ed.EncryptStream = stream
+	return ed.encrypter(), nil
+}
+
+// rekeyDecryptStream ratchets the decrypt subkey forward, and replaces
+// DecryptStream with a stream keyed with it.
+func (ed *StreamEncryptDecrypter) rekeyDecryptStream() (cipher.Stream, error) {
+	if ed.decryptSubkey == nil {
+		return nil, errors.New("peer rekeyed, but DecryptStream was not derived from DecryptKey")
+	}
+
+	key, err := ratchet(ed.decryptSubkey, ed.decryptGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := ed.newStream("decrypt", key, ed.DecryptIV, ed.StreamDecrypter)
+	if err != nil {
+		return nil, err
+	}
+
+	ed.decryptSubkey = key
+	ed.decryptGeneration++
+	ed.DecryptStream = stream
+	return ed.decrypter(), nil
+}
+
+// ratchet derives the subkey following key, and zeroes key in place. The
+// generation counter salts derivation, so subkeys never cycle.
+func ratchet(key []byte, generation uint64) ([]byte, error) {
+	salt := make([]byte, 8)
+	binary.BigEndian.PutUint64(salt, generation)
+
+	next, err := deriveKey(key, salt, "groundhog-rekey", len(key))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range key {
+		key[i] = 0
+	}
+	return next, nil
+}
@@ -0,0 +1,41 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		set  func(ed *StreamEncryptDecrypter)
+		ok   bool
+	}{
+		{"symmetric", func(ed *StreamEncryptDecrypter) {}, true},
+		{"asymmetric keys", func(ed *StreamEncryptDecrypter) {
+			ed.DecryptKey = bytes.Repeat([]byte{0x24}, len(testKey))
+		}, true},
+		{"asymmetric IVs", func(ed *StreamEncryptDecrypter) {
+			ed.Salted = false
+			ed.DecryptIV = bytes.Repeat([]byte{0x24}, len(ed.DecryptIV))
+		}, true},
+		{"authenticated", func(ed *StreamEncryptDecrypter) {
+			ed.DecryptKey = bytes.Repeat([]byte{0x24}, len(testKey))
+			ed.Authenticated = true
+		}, true},
+		{"asymmetric modes", func(ed *StreamEncryptDecrypter) {
+			ed.AllowAsymmetricModes = true
+			ed.StreamDecrypter = cipher.NewOFB
+		}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ed := newTestStream(t, CTR)
+			tt.set(ed)
+
+			if err := ed.SelfTest(); (err == nil) != tt.ok {
+				t.Fatalf("SelfTest returned %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -29,12 +29,22 @@ import (
 // 				name that follow, there is no terminating NUL octet.
 // 		- 0x04: the address is a version-6 IP address, with a length of 16
 // 				octets.
+// As the length of a domain name takes a single octet, domain names longer
+// than MaxDomainLen bytes can't be encoded, and are rejected with
+// ErrDomainTooLong rather than truncated.
 type Addr struct {
 	IP     net.IP
 	Domain string
 	Port   uint16
 }
 
+// MaxDomainLen is the maximum length of a domain name in bytes that fits in a
+// SOCKS5 address.
+const MaxDomainLen = 255
+
+// ErrDomainTooLong is returned for a domain name longer than MaxDomainLen.
+var ErrDomainTooLong = errors.New("domain name too long")
+
 // NewAddrFromBuffer parse a byte array containing a SOCKS5 address-port
 // schema specified in RFC1928, and returns a Addr struct.
 func NewAddrFromBuffer(buf []byte) (*Addr, error) {
@@ -48,7 +58,7 @@ func NewAddrFromReader(rd io.Reader) (*Addr, error) {
 
 	atyp := []byte{0}
 
-	if _, err := rd.Read(atyp); err != nil {
+	if _, err := io.ReadFull(rd, atyp); err != nil {
 		return nil, err
 	}
 
@@ -67,9 +77,12 @@ func NewAddrFromReader(rd io.Reader) (*Addr, error) {
 		addr.IP = ip
 	case AtypDomain:
 		domainLen := []byte{0}
-		if _, err := rd.Read(domainLen); err != nil {
+		if _, err := io.ReadFull(rd, domainLen); err != nil {
 			return nil, err
 		}
+		if domainLen[0] == 0 {
+			return nil, errors.New("empty domain name")
+		}
 		domain := make([]byte, int(domainLen[0]))
 		if _, err := io.ReadAtLeast(rd, domain, int(domainLen[0])); err != nil {
 			return nil, err
@@ -84,7 +97,7 @@ func NewAddrFromReader(rd io.Reader) (*Addr, error) {
 		}
 
 	default:
-		return nil, fmt.Errorf("unsupported address type %#xs", atyp[0])
+		return nil, fmt.Errorf("unsupported address type %#x", atyp[0])
 	}
 
 	port := []byte{0, 0}
@@ -109,6 +122,8 @@ func NewAddrFromString(s string) (*Addr, error) {
 
 	if ip := net.ParseIP(hostStr); ip != nil {
 		addr.IP = ip
+	} else if len(hostStr) > MaxDomainLen {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrDomainTooLong, len(hostStr), MaxDomainLen)
 	} else {
 		addr.Domain = hostStr
 	}
@@ -128,13 +143,15 @@ func (addr Addr) Marshal() ([]byte, error) {
 
 	if addr.IP != nil {
 		// prefer IP over FQDN
-		if len(addr.IP) == 4 {
+		if ip4 := addr.IP.To4(); ip4 != nil {
 			builder.WriteByte(AtypIPv4)
-			builder.Write(addr.IP.To4())
+			builder.Write(ip4)
 		} else {
 			builder.WriteByte(AtypIPv6)
 			builder.Write(addr.IP.To16())
 		}
+	} else if len(addr.Domain) > MaxDomainLen {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrDomainTooLong, len(addr.Domain), MaxDomainLen)
 	} else if addr.Domain != "" {
 		builder.WriteByte(AtypDomain)
 		builder.WriteByte(byte(len(addr.Domain)))
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		addr Addr
+		atyp byte
+		len  int // of the marshaled address
+	}{
+		{"IPv4", Addr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, AtypIPv4, 1 + 4 + 2},
+		{"IPv6", Addr{IP: net.ParseIP("2001:db8::1"), Port: 443}, AtypIPv6, 1 + 16 + 2},
+		{"domain", Addr{Domain: "example.com", Port: 8080}, AtypDomain, 1 + 1 + 11 + 2},
+		{"255-byte domain", Addr{Domain: strings.Repeat("a", MaxDomainLen), Port: 65535}, AtypDomain, 1 + 1 + 255 + 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.addr.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b[0] != tt.atyp || len(b) != tt.len {
+				t.Fatalf("marshaled to ATYP %#x of %d bytes, want ATYP %#x of %d bytes", b[0], len(b), tt.atyp, tt.len)
+			}
+
+			// followed by data not part of the address, which is left unread
+			rd := bytes.NewReader(append(b, "data"...))
+			addr, err := NewAddrFromReader(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rd.Len() != len("data") {
+				t.Fatalf("%d bytes left unread, want %d", rd.Len(), len("data"))
+			}
+
+			if !addr.IP.Equal(tt.addr.IP) || addr.Domain != tt.addr.Domain || addr.Port != tt.addr.Port {
+				t.Fatalf("round-tripped to %+v, want %+v", addr, tt.addr)
+			}
+		})
+	}
+}
+
+func TestAddrDomainTooLong(t *testing.T) {
+	addr := Addr{Domain: strings.Repeat("a", MaxDomainLen+1), Port: 80}
+	if _, err := addr.Marshal(); !errors.Is(err, ErrDomainTooLong) {
+		t.Fatalf("error %v, want %v", err, ErrDomainTooLong)
+	}
+}
+
+func TestAddrFromReaderChunked(t *testing.T) {
+	for _, n := range []int{1, 127, 128, MaxDomainLen} {
+		want := Addr{Domain: strings.Repeat("a", n), Port: 443}
+		b, err := want.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, chunked := range map[string]func(io.Reader) io.Reader{
+			"one byte":     iotest.OneByteReader,
+			"half":         iotest.HalfReader,
+			"data and EOF": iotest.DataErrReader,
+		} {
+			addr, err := NewAddrFromReader(chunked(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("%d-byte domain read %s: %v", n, name, err)
+			}
+			if addr.Domain != want.Domain || addr.Port != want.Port {
+				t.Fatalf("%d-byte domain read %s as %+v, want %+v", n, name, addr, want)
+			}
+
+			// cut off within the domain
+			_, err = NewAddrFromReader(chunked(bytes.NewReader(b[:2+n/2])))
+			if n > 1 && err != io.ErrUnexpectedEOF {
+				t.Fatalf("truncated %d-byte domain read %s: error %v, want %v", n, name, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
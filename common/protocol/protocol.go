@@ -5,7 +5,9 @@ package protocol
 
 import (
 	"errors"
+	"net"
 	"strings"
+	"syscall"
 )
 
 // Address type indication byte used for SOCKS5 and Groundhog protocol
@@ -46,8 +48,12 @@ const (
 	CipherAES256OFB byte = 0x09
 )
 
-// ErrToRepCode convert error to SOCKS/Groundhog protocol reply code by
-// matching string pattern in error message.
+// ErrToRepCode convert error to SOCKS/Groundhog protocol reply code. Errors
+// from dialing (e.g. *net.OpError) are matched by their underlying
+// syscall.Errno, timeouts by net.Error, failed lookups by *net.DNSError, and
+// ErrDomainTooLong as address type not supported.
+// Anything else, e.g. errors from RepToErr, is matched by string pattern in
+// error message.
 //		0x00 succeeded
 // 		0x01 general server failure
 //		0x02 connection not allowed by ruleset
@@ -63,6 +69,25 @@ func ErrToRep(err error) byte {
 		return RepSucceeded
 	}
 
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDomainTooLong):
+		return RepAddressTypeNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return RepHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT):
+		return RepTTLExpired
+	case errors.As(err, &dnsErr):
+		return RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	}
+
 	msg := err.Error()
 	// TODO: don't hard code these values
 	switch {
@@ -70,10 +95,10 @@ func ErrToRep(err error) byte {
 		return RepGeneralFailure
 	case strings.Contains(msg, "connection not allowed by ruleset"):
 		return RepNotAllowByRuleset
-	case strings.Contains(msg, "network unreachable"):
-		return RepNetworkUnreachable
-	case strings.Contains(msg, "no such host"), strings.Contains(msg, "host unreachable"):
+	case strings.Contains(msg, "network unreachable"), strings.Contains(msg, "network is unreachable"):
 		return RepNetworkUnreachable
+	case strings.Contains(msg, "no such host"), strings.Contains(msg, "host unreachable"), strings.Contains(msg, "no route to host"):
+		return RepHostUnreachable
 	case strings.Contains(msg, "connection refused"):
 		return RepConnectionRefused
 	case strings.Contains(msg, "connection timed out"), strings.Contains(msg, "TTL expired"):
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// dialError wraps errno as returned by dialing with net.Dialer.
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrToRep(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want byte
+	}{
+		{nil, RepSucceeded},
+		{dialError(syscall.ECONNREFUSED), RepConnectionRefused},
+		{dialError(syscall.ENETUNREACH), RepNetworkUnreachable},
+		{dialError(syscall.EHOSTUNREACH), RepHostUnreachable},
+		{dialError(syscall.EHOSTDOWN), RepHostUnreachable},
+		{dialError(syscall.ETIMEDOUT), RepTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, RepHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, RepTTLExpired},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), RepTTLExpired},
+		{fmt.Errorf("%w: 256 bytes", ErrDomainTooLong), RepAddressTypeNotSupported},
+		{dialError(syscall.EACCES), RepGeneralFailure},
+	} {
+		if got := ErrToRep(tt.err); got != tt.want {
+			t.Errorf("ErrToRep(%v) = %#x, want %#x", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRepToErr(t *testing.T) {
+	if err := RepToErr(RepSucceeded); err != nil {
+		t.Fatalf("RepToErr(RepSucceeded) = %v, want nil", err)
+	}
+
+	// errors from a peer's reply map back to the same code when relayed
+	for rep := RepGeneralFailure; rep <= RepCipherNotSupported; rep++ {
+		err := RepToErr(rep)
+		if err == nil {
+			t.Fatalf("RepToErr(%#x) = nil", rep)
+		}
+		if got := ErrToRep(err); got != rep {
+			t.Errorf("ErrToRep(RepToErr(%#x)) = %#x", rep, got)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tabjy/groundhog/common/adt"
+)
+
+// CachingResolver is a Resolver caching results of another Resolver. Failed
+// resolutions (e.g. NXDOMAIN) are cached as well, usually for a shorter time.
+// The zero value for CachingResolver is not valid, Resolver must be set.
+//
+// CachingResolver implements MultiResolver. If Resolver is not a
+// MultiResolver, ResolveAll returns the single address from Resolve.
+type CachingResolver struct {
+	Resolver Resolver // Resolver to cache results of.
+
+	TTL         time.Duration // How long a resolved address is cached. If 0, 1 minute would be used.
+	NegativeTTL time.Duration // How long a failure is cached. If 0, 5 seconds would be used.
+	MaxEntries  int           // Maximum number of hosts cached. If 0, 1024 would be used.
+
+	once  sync.Once
+	cache *adt.LRUMap
+
+	now func() time.Time // time.Now if nil, replaced in tests
+}
+
+type resolverEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Resolve implements Resolve in Resolver.
+func (r *CachingResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	ips, err := r.ResolveAll(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// ResolveAll implements ResolveAll in MultiResolver.
+func (r *CachingResolver) ResolveAll(ctx context.Context, host string) ([]net.IP, error) {
+	r.once.Do(func() {
+		maxEntries := r.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = 1024
+		}
+		r.cache = adt.NewLRUMap(maxEntries)
+	})
+
+	if v, ok := r.cache.Get(host); ok {
+		entry := v.(*resolverEntry)
+		if r.clock().Before(entry.expires) {
+			return entry.ips, entry.err
+		}
+		r.cache.Remove(host)
+	}
+
+	ips, err := r.resolveAll(ctx, host)
+	if err != nil && ctx.Err() != nil {
+		// failed for being canceled, which says nothing about host
+		return nil, err
+	}
+
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	if err != nil {
+		ttl = r.NegativeTTL
+		if ttl == 0 {
+			ttl = 5 * time.Second
+		}
+	}
+
+	r.cache.Put(host, &resolverEntry{ips: ips, err: err, expires: r.clock().Add(ttl)})
+	return ips, err
+}
+
+func (r *CachingResolver) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+func (r *CachingResolver) resolveAll(ctx context.Context, host string) ([]net.IP, error) {
+	if resolver, ok := r.Resolver.(MultiResolver); ok {
+		return resolver.ResolveAll(ctx, host)
+	}
+
+	ip, err := r.Resolver.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{ip}, nil
+}
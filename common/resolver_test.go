@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// countingResolver resolves every host to 192.0.2.1, or fails with err if
+// set, counting resolutions.
+type countingResolver struct {
+	n   int
+	err error
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	r.n++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return net.IPv4(192, 0, 2, 1), nil
+}
+
+// fakeClock is a clock for CachingResolver advanced by hand.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		ttl  time.Duration
+	}{
+		{"positive", nil, time.Minute},
+		{"negative", errors.New("no such host"), 5 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &countingResolver{err: tt.err}
+			clock := &fakeClock{t: time.Unix(0, 0)}
+			r := &CachingResolver{Resolver: upstream, now: clock.now}
+
+			for _, step := range []struct {
+				elapsed time.Duration
+				n       int // resolutions by upstream so far
+			}{
+				{0, 1},
+				{tt.ttl - time.Nanosecond, 1}, // cached
+				{tt.ttl, 2},                   // expired, so resolved again
+				{tt.ttl + time.Second, 2},     // cached again
+			} {
+				clock.t = time.Unix(0, 0).Add(step.elapsed)
+
+				ip, err := r.Resolve(context.Background(), "example.com")
+				if err != tt.err {
+					t.Fatalf("after %v: error %v, want %v", step.elapsed, err, tt.err)
+				}
+				if tt.err == nil && !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+					t.Fatalf("after %v: resolved to %v", step.elapsed, ip)
+				}
+				if upstream.n != step.n {
+					t.Fatalf("after %v: %d resolutions, want %d", step.elapsed, upstream.n, step.n)
+				}
+			}
+		})
+	}
+}
+
+func TestCachingResolverCanceled(t *testing.T) {
+	upstream := &countingResolver{err: context.Canceled}
+	r := &CachingResolver{Resolver: upstream}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 1; i <= 2; i++ {
+		if _, err := r.Resolve(ctx, "example.com"); err == nil {
+			t.Fatal("canceled resolution succeeded")
+		}
+		if upstream.n != i {
+			t.Fatalf("canceled resolution cached")
+		}
+	}
+}
@@ -5,11 +5,14 @@ package tcp
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tabjy/groundhog/common/adt"
 	"github.com/tabjy/yagl"
@@ -55,18 +58,55 @@ type Server struct {
 	Host string // IP address or hostname to listen on. Leave empty for an unspecified address.
 	Port uint16 // Port to listen on. A port number is automatically chosen if left empty or 0.
 
+	// Network is either "tcp" or "unix". If "unix", Host is the path of a
+	// Unix domain socket to listen on, and Port is ignored. A stale socket
+	// file left by a previous run is removed before listening, and the
+	// socket file is removed once the listener is closed. If empty, "tcp"
+	// would be used.
+	Network string
+
+	// Addrs lists additional addresses to listen on, along with Host:Port,
+	// as "host:port", or paths if Network is "unix". Connections accepted on
+	// all of them are handled alike.
+	Addrs []string
+
+	// ListenConfig, if set, creates listeners in Listen, e.g. with a Control
+	// function setting SO_REUSEPORT, so that a new process can take over
+	// listening before the old one is shut down. To serve listeners created
+	// otherwise, e.g. from systemd socket activation with net.FileListener,
+	// pass them to ServeListener instead.
+	ListenConfig *net.ListenConfig
+
 	Handler Handler // Handler for handle a TCP connection. If nil, EchoHandler will be used.
 
+	// MaxConns limits the number of connections handled at once. At the
+	// limit, accepting waits for a connection to close, or if RejectWhenFull
+	// is set, new connections are closed immediately. If 0, it's unlimited.
+	MaxConns       int
+	RejectWhenFull bool
+
+	// AcceptFilter, if set, is called with every connection as soon as it's
+	// accepted, before it counts towards MaxConns or reaches Handler. The
+	// connection is closed if it returns false, e.g. to ban IP addresses by
+	// RemoteAddr. It's called from the accepting goroutine, so it should
+	// return quickly.
+	AcceptFilter func(conn net.Conn) bool
+
 	// Logger specifies an optional logger.
 	// If nil, logging goes to os.Stderr via a yagl standard logger.
 	Logger yagl.Logger
 
-	ln    net.Listener
+	lns   []net.Listener
 	conns adt.Set
 
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
+
+	// mu guards shuttingDown, and adding connections to wg and conns, so that
+	// no connection is added once Shutdown or Close waits on or closes them
+	mu           sync.Mutex
+	shuttingDown bool
 }
 
 func (srv *Server) logger() yagl.Logger {
@@ -76,31 +116,100 @@ func (srv *Server) logger() yagl.Logger {
 	return srv.Logger
 }
 
-// Listen listens on srv.Host:srv.Port. If a Listener is ready created, the old
-// one will be closed and replaced.
+// Listen listens on srv.Host:srv.Port, or srv.Host if srv.Network is "unix",
+// and on each of srv.Addrs. If Listeners are already created, the old ones
+// will be replaced. If listening on any address fails, listeners created so
+// far are closed.
 func (srv *Server) Listen() error {
-	addr := net.JoinHostPort(srv.Host, strconv.Itoa(int(srv.Port)))
+	network := srv.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	var addrs []string
+	switch network {
+	case "tcp":
+		addrs = append(addrs, net.JoinHostPort(srv.Host, strconv.Itoa(int(srv.Port))))
+	case "unix":
+		addrs = append(addrs, srv.Host)
+	default:
+		return fmt.Errorf("common: unsupported network %q", network)
+	}
+	addrs = append(addrs, srv.Addrs...)
+
+	var lns []net.Listener
+	for _, addr := range addrs {
+		ln, err := srv.listen(network, addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+	srv.lns = lns
+
+	return nil
+}
 
-	ln, err := net.Listen("tcp", addr)
+func (srv *Server) listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			srv.logger().Errorf("failed to listen on %s: %v", addr, err)
+			return nil, err
+		}
+	}
+
+	lc := srv.ListenConfig
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+
+	ln, err := lc.Listen(context.Background(), network, addr)
 	if err != nil {
 		srv.logger().Errorf("failed to listen on %s: %v", addr, err)
+		return nil, err
+	}
+	srv.logger().Infof("Server listening on %v", ln.Addr())
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the Unix domain socket file at path if nothing is
+// listening on it. A file of any other type is left alone, so that listening
+// fails on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
-	srv.ln = ln
-	srv.logger().Infof("Server listening on %v", srv.ln.Addr())
 
-	return nil
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("common: %s is in use", path)
+	}
+
+	return os.Remove(path)
 }
 
-// Serve accepts incoming connections on the Listener ln, creating a new
-// service goroutine for each. The service goroutines read requests and then
-// call srv.Handler to handle to them. Make sure Listen is called before
-// calling this function.
+// Serve accepts incoming connections on the Listeners created by Listen,
+// creating a new service goroutine for each. The service goroutines read
+// requests and then call srv.Handler to handle to them. Make sure Listen is
+// called before calling this function.
 //
 // Serve always returns a non-nil error. After Shutdown or Close, the returned
-// error is ErrServerClosed.
+// error is ErrServerClosed. If accepting fails on any Listener, all of them
+// are closed, and the error is returned.
 func (srv *Server) Serve() error {
-	if srv.ln == nil {
+	if len(srv.lns) == 0 {
 		return ErrServerNotListening
 	}
 
@@ -112,28 +221,116 @@ func (srv *Server) Serve() error {
 
 	srv.ctx, srv.cancel = context.WithCancel(context.Background())
 
+	var sem chan struct{} // holds a token for each connection being handled
+	if srv.MaxConns > 0 {
+		sem = make(chan struct{}, srv.MaxConns)
+	}
+
+	errs := make(chan error, len(srv.lns))
+	for _, ln := range srv.lns {
+		go func(ln net.Listener) {
+			errs <- srv.accept(ln, sem)
+		}(ln)
+	}
+
+	var firstErr error
+	for range srv.lns {
+		err := <-errs
+		if firstErr == nil {
+			firstErr = err
+			if err != ErrServerClosed {
+				srv.closeListeners() // stop the rest as well
+			}
+		}
+	}
+	return firstErr
+}
+
+// accept runs the accept loop of ln, until ln is closed or fails.
+func (srv *Server) accept(ln net.Listener, sem chan struct{}) error {
+	var delay time.Duration // how long to sleep on accept failure
 	for true {
-		conn, err := srv.ln.Accept()
+		if sem != nil && !srv.RejectWhenFull {
+			sem <- struct{}{}
+		}
+
+		conn, err := ln.Accept()
 		if err != nil {
+			if sem != nil && !srv.RejectWhenFull {
+				<-sem // no connection to hold the token
+			}
+
 			// server level error, causing server to stop
 			// ln.Accept unblocks and returns error when ln.Close called, by design
 			if strings.Contains(err.Error(), "use of closed network connection") {
 
 				return ErrServerClosed
 			}
+
+			// temporary errors (e.g. running out of file descriptors) are
+			// retried with an exponential backoff, same as net/http
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if max := 1 * time.Second; delay > max {
+					delay = max
+				}
+				srv.logger().Errorf("accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
 			srv.logger().Errorf("Server stopping for error: %v", err)
 			return err
 		}
+		delay = 0
+
+		if srv.AcceptFilter != nil && !srv.AcceptFilter(conn) {
+			if sem != nil && !srv.RejectWhenFull {
+				<-sem
+			}
+			srv.logger().Debugf("rejecting connection from %v by AcceptFilter", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		if sem != nil && srv.RejectWhenFull {
+			select {
+			case sem <- struct{}{}:
+			default:
+				srv.logger().Warnf("rejecting connection from %v, %d connections already", conn.RemoteAddr(), srv.MaxConns)
+				conn.Close()
+				continue
+			}
+		}
 
+		// accepted while Shutdown or Close is closing the listeners
+		srv.mu.Lock()
+		if srv.shuttingDown {
+			srv.mu.Unlock()
+			if sem != nil {
+				<-sem
+			}
+			conn.Close()
+			return ErrServerClosed
+		}
 		srv.wg.Add(1)
+		srv.conns.Add(conn)
+		srv.mu.Unlock()
+
 		go func() {
 			defer func() {
-				srv.wg.Add(-1)
+				if sem != nil {
+					<-sem
+				}
+				srv.wg.Done()
 				srv.conns.Remove(conn)
 				srv.logger().Tracef("%d connections still active", srv.conns.Len())
 			}()
 
-			srv.conns.Add(conn)
 			srv.logger().Tracef("new connection from %v", conn.RemoteAddr())
 
 			srv.logger().Tracef("connection to be handled by %T", srv.Handler)
@@ -158,6 +355,15 @@ func (srv *Server) Serve() error {
 	return nil
 }
 
+// ServeListener is like Serve, but accepts incoming connections on lns,
+// instead of ones created by Listen, e.g. inherited from systemd socket
+// activation, or created with custom socket options. lns are closed by
+// Shutdown or Close.
+func (srv *Server) ServeListener(lns ...net.Listener) error {
+	srv.lns = lns
+	return srv.Serve()
+}
+
 // ListenAndServe first call Listen, then calls Server to handle incoming
 // connections. If srv.Addr is blank, ":tcp" is used.
 //
@@ -171,7 +377,48 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve()
 }
 
+// stopAccepting makes accept loops close connections accepted from now on,
+// instead of handling them.
+func (srv *Server) stopAccepting() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.shuttingDown = true
+}
+
+// closeListeners closes all Listeners, returning the first error.
+func (srv *Server) closeListeners() error {
+	var firstErr error
+	for _, ln := range srv.lns {
+		if err := ln.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// addrs returns addresses of all Listeners, for logging.
+func (srv *Server) addrs() []net.Addr {
+	addrs := make([]net.Addr, len(srv.lns))
+	for i, ln := range srv.lns {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// cancelHandlers notifies all handlers to finish whatever is left. It's a
+// no-op if Serve is not called yet.
+func (srv *Server) cancelHandlers() {
+	if srv.cancel != nil {
+		srv.cancel()
+	}
+}
+
 func (srv *Server) forceCloseConns() {
+	if srv.conns == nil {
+		return // Serve is not called yet
+	}
+
 	srv.logger().Tracef("forcing to close all connections, %d remaining", srv.conns.Len())
 	srv.conns.ForEach(func(element interface{}) {
 		conn := element.(net.Conn)
@@ -182,7 +429,6 @@ func (srv *Server) forceCloseConns() {
 		}
 	})
 	srv.conns.Clear()
-	srv.wg.Done()
 }
 
 // Close immediately closes active net.Listener and closes all active
@@ -192,48 +438,68 @@ func (srv *Server) forceCloseConns() {
 // Close returns any error returned from closing the Server's underlying
 // Listener(s).
 func (srv *Server) Close() error {
-	srv.logger().Infof("closing server listening on %v", srv.ln.Addr())
+	srv.logger().Infof("closing server listening on %v", srv.addrs())
 
-	// first close listener, so no more incoming connections
-	if err := srv.ln.Close(); err != nil {
+	// first close listeners, so no more incoming connections
+	srv.stopAccepting()
+	if err := srv.closeListeners(); err != nil {
 		srv.logger().Errorf("failed to close listener: %v", err)
 		return err
 	}
 
-	srv.cancel() // notify all handlers to finish whatever is left
+	srv.cancelHandlers()
 	srv.forceCloseConns()
 
 	return nil
 }
 
-// Shutdown immediately closes active net.Listener and sends close signals to
-// all actives connection through context; still, it's up to connections'
-// handlers to decide what to do with close signals. Shutdown wait for all
-// connection to be closed before returning.
-//
-// Best practice: wait for a certain amount of time, then just call Close to
-// force close all connections.
+// Shutdown immediately closes active net.Listener, and waits for all active
+// connections to be closed by their handlers. If ctx is done before that,
+// handlers are notified through their context, remaining connections are
+// force closed, and ctx.Err() is returned.
 //
-// Shutdown returns any error returned from closing the Server's underlying
-// Listener(s).
-func (srv *Server) Shutdown() error {
-	srv.logger().Infof("shutting down server listening on %v", srv.ln.Addr())
-
-	// first close listener, so no more incoming connections
-	if err := srv.ln.Close(); err != nil {
+// Shutdown otherwise returns any error returned from closing the Server's
+// underlying Listener(s).
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.logger().Infof("shutting down server listening on %v", srv.addrs())
+
+	// first close listeners, so no more incoming connections
+	srv.stopAccepting()
+	if err := srv.closeListeners(); err != nil {
 		srv.logger().Errorf("failed to close listener: %v", err)
 		return err
 	}
 
-	srv.cancel() // notify all handler to finish whatever is left
-	srv.logger().Infof("shutdown signal sent, waiting for all connection to be closed, %d remaining", srv.conns.Len())
-	srv.wg.Wait()
-	// by the time wg.Wait unblocks, all connection SHOULD be closed
-	// but let's just check for sure, for debug purpose
-	if srv.conns.Len() != 0 {
-		srv.Logger.Warn("not all connection are closed upon Shutdown!")
-		srv.forceCloseConns()
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	srv.logger().Infof("waiting for all connection to be closed, %d remaining", srv.ActiveConns())
+	for {
+		select {
+		case <-done:
+			srv.cancelHandlers()
+			return nil
+		case <-ticker.C:
+			srv.logger().Infof("waiting for all connection to be closed, %d remaining", srv.ActiveConns())
+		case <-ctx.Done():
+			srv.logger().Warnf("shutdown timed out, forcing to close %d connections", srv.ActiveConns())
+			srv.cancelHandlers()
+			srv.forceCloseConns()
+			return ctx.Err()
+		}
 	}
+}
 
-	return nil
+// ActiveConns returns the number of connections being handled.
+func (srv *Server) ActiveConns() int {
+	if srv.conns == nil {
+		return 0
+	}
+	return srv.conns.Len()
 }
@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// echoed once the connection is being handled
+	conn.Write([]byte{0})
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// EchoHandler never returns on its own, so Shutdown has to give up
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after Shutdown returned %v, want io.EOF", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestCloseBeforeServe(t *testing.T) {
+	if err := (&Server{}).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Server{}).Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lateListener is a net.Listener whose Accept blocks until Close, and then
+// returns conn, as if it arrived while the listener was being closed.
+type lateListener struct {
+	net.Listener
+	conn      net.Conn
+	accepting chan struct{}
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (ln *lateListener) Accept() (net.Conn, error) {
+	close(ln.accepting)
+	<-ln.closed
+	return ln.conn, nil
+}
+
+func (ln *lateListener) Close() error {
+	ln.once.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *lateListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+type handlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f handlerFunc) ServeTCP(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+func TestShutdownAcceptedLate(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	ln := &lateListener{
+		conn:      conn,
+		accepting: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	handled := make(chan struct{}, 1)
+	srv := &Server{Handler: handlerFunc(func(ctx context.Context, conn net.Conn) {
+		handled <- struct{}{}
+	})}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeListener(ln) }()
+	<-ln.accepting
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want %v", err, ErrServerClosed)
+	}
+
+	select {
+	case <-handled:
+		t.Fatal("connection accepted during Shutdown was handled")
+	default:
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read from connection accepted during Shutdown returned %v, want io.EOF", err)
+	}
+}
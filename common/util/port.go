@@ -0,0 +1,62 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// GetFreePort asks the kernel for a port free to listen on, on all addresses,
+// with network, either "tcp" or "udp" (or their "4" and "6" variants). The
+// port is actually bound and released before returning, but may still be taken
+// by someone else before it's used.
+func GetFreePort(network string) (int, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ln, err := net.Listen(network, ":0")
+		if err != nil {
+			return 0, err
+		}
+		defer ln.Close()
+
+		return ln.Addr().(*net.TCPAddr).Port, nil
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(network, ":0")
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	default:
+		return 0, fmt.Errorf("unsupported network %s", network)
+	}
+}
+
+// GetFreeTCPPort is GetFreePort for "tcp".
+func GetFreeTCPPort() (int, error) {
+	return GetFreePort("tcp")
+}
+
+// GetFreeUDPPort is GetFreePort for "udp".
+func GetFreeUDPPort() (int, error) {
+	return GetFreePort("udp")
+}
+
+// GetFreePortInRange probes ports from min to max inclusively, and returns the
+// first one free to listen on with TCP, on all addresses.
+func GetFreePortInRange(min, max int) (int, error) {
+	if min < 1 || max > 65535 || min > max {
+		return 0, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	for port := min; port <= max; port++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d", min, max)
+}
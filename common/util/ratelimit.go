@@ -0,0 +1,112 @@
+package util
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitedConn returns a net.Conn reading from conn no faster than all of
+// limiters allow. Reads block until limiters allow, or ctx is done. Writes are
+// not limited.
+func RateLimitedConn(ctx context.Context, conn net.Conn, limiters ...*rate.Limiter) net.Conn {
+	if len(limiters) == 0 {
+		return conn
+	}
+	return &rateLimitedConn{Conn: conn, ctx: ctx, limiters: limiters}
+}
+
+type rateLimitedConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	// never read more than a limiter could allow at once
+	for _, l := range c.limiters {
+		if burst := l.Burst(); len(b) > burst {
+			b = b[:burst]
+		}
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, l := range c.limiters {
+			if err := l.WaitN(c.ctx, n); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *rateLimitedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// NewLimiter returns a rate.Limiter allowing bytesPerSec bytes per second, with
+// a burst of one second worth of bytes. It returns nil, i.e. unlimited, if
+// bytesPerSec is 0 or negative.
+func NewLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// KeyedLimiter keeps a rate.Limiter for each key, e.g. a client IP address.
+// Once more than capacity keys are tracked, limiters of the least recently
+// used keys are evicted, so that memory stays bounded however many keys are
+// seen. An evicted key starts over with a full burst. It's safe for
+// concurrent use.
+type KeyedLimiter struct {
+	limit    rate.Limit
+	burst    int
+	capacity int
+
+	mu       sync.Mutex
+	limiters map[string]*list.Element
+	lru      list.List // of *keyedEntry, most recently used first
+}
+
+type keyedEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+// NewKeyedLimiter returns a KeyedLimiter allowing events at limit per second,
+// with bursts of up to burst events, for each key, tracking up to capacity
+// keys, or any number of keys if capacity is 0.
+func NewKeyedLimiter(limit rate.Limit, burst int, capacity int) *KeyedLimiter {
+	return &KeyedLimiter{
+		limit:    limit,
+		burst:    burst,
+		capacity: capacity,
+		limiters: make(map[string]*list.Element),
+	}
+}
+
+// Allow reports whether an event for key may happen now.
+func (l *KeyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.limiters[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*keyedEntry).limiter.Allow()
+	}
+
+	if l.capacity > 0 && l.lru.Len() >= l.capacity {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.limiters, oldest.Value.(*keyedEntry).key)
+	}
+
+	entry := &keyedEntry{key: key, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.limiters[key] = l.lru.PushFront(entry)
+	return entry.limiter.Allow()
+}
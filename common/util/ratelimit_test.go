@@ -0,0 +1,90 @@
+package util
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedConnBurst(t *testing.T) {
+	lhs, rhs := net.Pipe()
+	defer lhs.Close()
+	defer rhs.Close()
+
+	conn := RateLimitedConn(context.Background(), lhs, NewLimiter(1024), NewLimiter(16))
+	go rhs.Write(make([]byte, 64))
+
+	// capped by the smallest burst, so a read never waits on more than one
+	// burst
+	n, err := conn.Read(make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Fatalf("read %d bytes, want 16", n)
+	}
+}
+
+func TestRateLimitedConnCanceled(t *testing.T) {
+	lhs, rhs := net.Pipe()
+	defer lhs.Close()
+	defer rhs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := RateLimitedConn(ctx, lhs, NewLimiter(1))
+	go rhs.Write(make([]byte, 2))
+
+	// the first byte takes the burst, so the second waits a second, unless ctx
+	// is done
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded despite ctx being canceled")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("read returned after %v, not once ctx is canceled", elapsed)
+	}
+}
+
+func TestKeyedLimiterEviction(t *testing.T) {
+	// a single event per key, never replenished
+	l := NewKeyedLimiter(0, 1, 2)
+
+	for _, key := range []string{"a", "b"} {
+		if !l.Allow(key) {
+			t.Fatalf("first event of %s not allowed", key)
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("second event of a allowed")
+	}
+
+	// a was used more recently than b, so c evicts b
+	if !l.Allow("c") {
+		t.Fatal("first event of c not allowed")
+	}
+	if l.Allow("a") {
+		t.Fatal("a evicted, want b evicted")
+	}
+	if !l.Allow("b") {
+		t.Fatal("b not evicted, so it didn't start over with a full burst")
+	}
+}
+
+func TestNewLimiterUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if NewLimiter(n) != nil {
+			t.Fatalf("NewLimiter(%d) is not nil", n)
+		}
+	}
+
+	lhs, _ := net.Pipe()
+	if conn := RateLimitedConn(context.Background(), lhs); conn != lhs {
+		t.Fatal("conn wrapped without limiters")
+	}
+}
@@ -2,49 +2,185 @@
 package util
 
 import (
+	"errors"
 	"io"
-	"sync"
 	"net"
+	"sync"
+	"time"
 )
 
+// ErrHalfCloseUnsupported is returned by CloseWrite if a connection can't be
+// half-closed.
+var ErrHalfCloseUnsupported = errors.New("half-close not supported")
+
+// DefaultBufferSize is the size of buffers data is copied with by Proxy, same
+// as by io.Copy.
+const DefaultBufferSize = 32 * 1024
+
+// BufferPool is a pool of buffers of the same size. It's safe for concurrent
+// use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a BufferPool of size-byte buffers.
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from p, allocating one if p is empty.
+func (p *BufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns buf to p, once it's no longer used.
+func (p *BufferPool) Put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
 // Proxy connect two ReadWriter, forward data between them in a full-duplex
 // manner. Proxy returns upon either EOF is reached on both ReadWriter or an
 // error occurs.
+//
+// Once EOF is reached on one ReadWriter, the other one is half-closed with
+// CloseWrite, so that its peer sees EOF as well, while data keeps flowing in
+// the other direction. If it can't be half-closed, both are closed instead.
+//
+// err is the first error occurred in either direction, as errors in the other
+// direction are likely caused by closing after it.
 func Proxy(lhs io.ReadWriter, rhs io.ReadWriter) (lhsWritten, rhsWritten int64, err error) {
+	return proxy(lhs, rhs, nil)
+}
+
+// ProxyBuffer is like Proxy, but data is copied with buffers from buffers,
+// one for each direction, held until Proxy returns. Where data doesn't go
+// through a buffer at all, e.g. spliced between TCP connections by io.Copy,
+// buffers is not used.
+func ProxyBuffer(lhs io.ReadWriter, rhs io.ReadWriter, buffers *BufferPool) (lhsWritten, rhsWritten int64, err error) {
+	return proxy(lhs, rhs, buffers)
+}
+
+// proxy implements Proxy, copying with buffers from buffers if not nil.
+func proxy(lhs io.ReadWriter, rhs io.ReadWriter, buffers *BufferPool) (lhsWritten, rhsWritten int64, err error) {
+	copyData := func(dst io.Writer, src io.Reader) (int64, error) {
+		if buffers == nil {
+			return io.Copy(dst, src)
+		}
+		buf := buffers.Get()
+		defer buffers.Put(buf)
+		return io.CopyBuffer(dst, src, *buf)
+	}
+
 	var wg sync.WaitGroup
+	var once sync.Once
+	setErr := func(e error) {
+		if e != nil {
+			once.Do(func() { err = e })
+		}
+	}
 
 	// copy from rhs to lhs
 	wg.Add(1)
 	go func() {
-		lhsWritten, err = io.Copy(lhs, rhs)
-		closeNetConn(lhs, rhs)
-		if err != nil {
-			wg.Done()
-		} else {
-			wg.Add(-1)
-		}
+		defer wg.Done()
+		var e error
+		lhsWritten, e = copyData(lhs, rhs)
+		setErr(e)
+		shutdown(lhs, rhs, e)
 	}()
 
 	// copy from lhs to rhs
 	wg.Add(1)
 	go func() {
-		rhsWritten, err = io.Copy(rhs, lhs)
-		closeNetConn(lhs, rhs)
-		if err != nil {
-			wg.Done()
-		} else {
-			wg.Add(-1)
-		}
+		defer wg.Done()
+		var e error
+		rhsWritten, e = copyData(rhs, lhs)
+		setErr(e)
+		shutdown(rhs, lhs, e)
 	}()
 
 	wg.Wait()
+	closeNetConn(lhs, rhs)
 	return
 }
 
-func closeNetConn(rws... io.ReadWriter) {
+// shutdown is called once copying from src to dst is done with err. dst is
+// half-closed if err is nil, otherwise, or if dst can't be half-closed, both
+// are closed, so that copying in the other direction is stopped as well.
+func shutdown(dst io.ReadWriter, src io.ReadWriter, err error) {
+	if err == nil && CloseWrite(dst) == nil {
+		return
+	}
+	closeNetConn(dst, src)
+}
+
+// CloseWrite shuts down the writing side of w, if it has a CloseWrite method,
+// as *net.TCPConn and *net.UnixConn do. ErrHalfCloseUnsupported is returned
+// otherwise. Wrappers of net.Conn may implement CloseWrite with CloseWrite on
+// the wrapped net.Conn.
+func CloseWrite(w io.Writer) error {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+func closeNetConn(rws ...io.ReadWriter) {
 	for _, v := range rws {
 		if conn, ok := v.(net.Conn); ok {
 			conn.Close()
 		}
 	}
-}
\ No newline at end of file
+}
+
+// ProxyIdle is like Proxy, but both connections are closed if no data flows
+// in either direction for idle. If idle is 0, it's equivalent to Proxy.
+func ProxyIdle(lhs net.Conn, rhs net.Conn, idle time.Duration) (lhsWritten, rhsWritten int64, err error) {
+	return ProxyIdleBuffer(lhs, rhs, idle, nil)
+}
+
+// ProxyIdleBuffer is like ProxyIdle, but copies with buffers as of
+// ProxyBuffer, unless buffers is nil.
+func ProxyIdleBuffer(lhs net.Conn, rhs net.Conn, idle time.Duration, buffers *BufferPool) (lhsWritten, rhsWritten int64, err error) {
+	if idle == 0 {
+		return proxy(lhs, rhs, buffers)
+	}
+
+	deadline := time.Now().Add(idle)
+	lhs.SetDeadline(deadline)
+	rhs.SetDeadline(deadline)
+
+	return proxy(
+		&idleConn{Conn: lhs, peer: rhs, idle: idle},
+		&idleConn{Conn: rhs, peer: lhs, idle: idle},
+		buffers,
+	)
+}
+
+// idleConn pushes back deadlines of itself and its peer on every successful
+// read, so a deadline is only hit by a idle pair of connections.
+type idleConn struct {
+	net.Conn
+	peer net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		deadline := time.Now().Add(c.idle)
+		c.Conn.SetDeadline(deadline)
+		c.peer.SetDeadline(deadline)
+	}
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	client, lhs := tcpPair(t)
+	rhs, server := tcpPair(t)
+
+	proxied := make(chan error, 1)
+	go func() {
+		_, _, err := Proxy(lhs, rhs)
+		proxied <- err
+	}()
+
+	// the client half-closes once its request is sent, as e.g. HTTP/1.0
+	// clients without Content-Length do
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server reads up to the FIN, relayed as a half-close
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	req, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req) != "request" {
+		t.Fatalf("server read %q, want \"request\"", req)
+	}
+
+	// and still responds after it
+	if _, err := server.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "response" {
+		t.Fatalf("client read %q, want \"response\"", res)
+	}
+
+	if err := <-proxied; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyCloseUnsupported(t *testing.T) {
+	// net.Pipe can't be half-closed, so EOF in one direction closes both
+	client, lhs := net.Pipe()
+	rhs, server := net.Pipe()
+
+	proxied := make(chan error, 1)
+	go func() {
+		_, _, err := Proxy(lhs, rhs)
+		proxied <- err
+	}()
+
+	client.Close()
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("server read returned %v, want io.EOF", err)
+	}
+	<-proxied
+}
@@ -0,0 +1,13 @@
+module github.com/tabjy/groundhog
+
+go 1.22
+
+require (
+	github.com/hashicorp/yamux v0.1.2
+	github.com/tabjy/yagl v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.31.0
+	golang.org/x/time v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0 // indirect
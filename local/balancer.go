@@ -0,0 +1,323 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// Strategy decides which remote of a Balancer a destination is dialed
+// through.
+type Strategy int
+
+// Strategies of Balancer.
+const (
+	RoundRobin Strategy = iota // Remotes take turns.
+	LeastConns                 // The remote with the fewest open connections, taking turns on ties.
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastConns:
+		return "least-connections"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultMaxFailures is the number of consecutive failures dialing a remote
+// after which it's ejected, if Balancer.MaxFailures is 0.
+const DefaultMaxFailures = 3
+
+// DefaultEjectTime is how long an ejected remote is skipped, if
+// Balancer.EjectTime is 0.
+const DefaultEjectTime = 30 * time.Second
+
+// Balancer implements common.Dialer by spreading destinations across several
+// groundhog remotes, picked by Strategy.
+//
+// Failing remotes are ejected passively: once dialing a remote fails
+// MaxFailures times in a row, it's skipped for EjectTime. The remote is then
+// probed, actively in the background, or by the next destination picking it,
+// which either brings it back, or ejects it for another EjectTime. Probing in
+// the background starts with the first dial, and stops once the Balancer is
+// closed. A destination failing to reach a remote is
+// tried on the others, while a destination failing on the remote side, e.g.
+// refused by the destination itself, is not. If all remotes are ejected, they
+// are tried regardless.
+//
+// Remotes should have MaxRetries of 0, so that a remote backing off fails
+// over to the others right away.
+type Balancer struct {
+	Remotes  []*Dialer
+	Strategy Strategy
+
+	MaxFailures int
+	EjectTime   time.Duration
+
+	mu     sync.Mutex
+	states []remoteState // of Remotes, by index
+	next   int           // index of the remote to start picking from
+
+	closed  bool
+	cancel  context.CancelFunc // stops probing, nil until it starts
+	probing sync.WaitGroup
+}
+
+type remoteState struct {
+	conns     int       // connections open through the remote
+	failures  int       // consecutive failures dialing the remote
+	ejectedAt time.Time // when the remote is ejected, or zero
+	probed    bool      // whether the remote is being probed in the background
+}
+
+// balancedConn is a connection through a remote of a Balancer, which is
+// released once closed.
+type balancedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *balancedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *balancedConn) CloseWrite() error {
+	return util.CloseWrite(c.Conn)
+}
+
+// Dial implements Dial in common.Dialer.
+func (b *Balancer) Dial(network, address string) (net.Conn, error) {
+	return b.DialContext(context.Background(), network, address)
+}
+
+// DialContext implements DialContext in common.Dialer. Only TCP networks are
+// supported.
+func (b *Balancer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(b.Remotes) == 0 {
+		return nil, errors.New("local: no remotes to balance across")
+	}
+
+	req, err := marshalRequest(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	tried := make([]bool, len(b.Remotes))
+	var lastErr error
+	for {
+		i := b.pick(tried)
+		if i < 0 {
+			return nil, lastErr
+		}
+		tried[i] = true
+
+		conn, err := b.Remotes[i].open(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				b.release(i)
+				return nil, ctx.Err()
+			}
+			b.failed(i, err)
+			lastErr = err
+			continue
+		}
+		b.succeeded(i)
+
+		conn, err = request(ctx, conn, req)
+		if err != nil {
+			b.release(i)
+			return nil, err
+		}
+		return &balancedConn{Conn: conn, release: func() { b.release(i) }}, nil
+	}
+}
+
+// pick returns the index of the remote to dial next, among those not tried
+// yet, or -1 if all are tried. The remote is counted as having a connection
+// open until released.
+func (b *Balancer) pick(tried []bool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ejectTime := b.ejectTime()
+
+	if b.states == nil {
+		b.states = make([]remoteState, len(b.Remotes))
+	}
+	if b.cancel == nil && !b.closed {
+		var ctx context.Context
+		ctx, b.cancel = context.WithCancel(context.Background())
+		b.probing.Add(1)
+		go b.probe(ctx, ejectTime)
+	}
+
+	pick := func(skipEjected bool) int {
+		picked := -1
+		for j := range b.Remotes {
+			i := (b.next + j) % len(b.Remotes)
+			st := &b.states[i]
+			if tried[i] || (skipEjected && !st.ejectedAt.IsZero() && time.Since(st.ejectedAt) < ejectTime) {
+				continue
+			}
+
+			if picked < 0 || (b.Strategy == LeastConns && st.conns < b.states[picked].conns) {
+				picked = i
+			}
+			if b.Strategy != LeastConns {
+				break
+			}
+		}
+		return picked
+	}
+
+	i := pick(true)
+	if i < 0 {
+		i = pick(false)
+	}
+	if i >= 0 {
+		b.next = i + 1
+		b.states[i].conns++
+	}
+	return i
+}
+
+// succeeded brings back remote i, if ejected, once it's dialed.
+func (b *Balancer) succeeded(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := &b.states[i]
+	if !st.ejectedAt.IsZero() {
+		b.Remotes[i].logger().Infof("remote %s is back in rotation", b.Remotes[i].addr())
+	}
+	st.failures = 0
+	st.ejectedAt = time.Time{}
+}
+
+// failed records a failure dialing remote i with err, and ejects it once
+// failed too many times in a row.
+func (b *Balancer) failed(i int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := &b.states[i]
+	st.conns--
+	st.failures++
+
+	maxFailures := b.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultMaxFailures
+	}
+
+	if st.failures >= maxFailures {
+		if st.ejectedAt.IsZero() {
+			b.Remotes[i].logger().Warnf("ejecting remote %s after %d consecutive failures: %v", b.Remotes[i].addr(), st.failures, err)
+		}
+		st.ejectedAt = time.Now()
+	}
+}
+
+// release counts a connection through remote i as closed.
+func (b *Balancer) release(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.states[i].conns--
+}
+
+// ejectTime returns EjectTime, or DefaultEjectTime if unset.
+func (b *Balancer) ejectTime() time.Duration {
+	if b.EjectTime <= 0 {
+		return DefaultEjectTime
+	}
+	return b.EjectTime
+}
+
+// probe dials remotes ejected for ejectTime in the background, until ctx is
+// done. Ejected remotes are checked twice per ejectTime, so none waits much
+// longer than ejectTime to be probed.
+func (b *Balancer) probe(ctx context.Context, ejectTime time.Duration) {
+	defer b.probing.Done()
+
+	ticker := time.NewTicker(ejectTime / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, i := range b.due(ejectTime) {
+			b.probing.Add(1)
+			go b.probeRemote(ctx, i)
+		}
+	}
+}
+
+// due returns the indexes of remotes ejected for ejectTime, which aren't
+// being probed already. They are marked as probed, and counted as having a
+// connection open, as pick does.
+func (b *Balancer) due(ejectTime time.Duration) []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var due []int
+	for i := range b.states {
+		st := &b.states[i]
+		if st.ejectedAt.IsZero() || st.probed || time.Since(st.ejectedAt) < ejectTime {
+			continue
+		}
+
+		st.probed = true
+		st.conns++
+		due = append(due, i)
+	}
+	return due
+}
+
+// probeRemote dials remote i, and brings it back, or ejects it for another
+// EjectTime, as a destination dialing it would.
+func (b *Balancer) probeRemote(ctx context.Context, i int) {
+	defer b.probing.Done()
+
+	conn, err := b.Remotes[i].open(ctx)
+	switch {
+	case err == nil:
+		conn.Close()
+		b.succeeded(i)
+		b.release(i)
+	case ctx.Err() != nil:
+		b.release(i)
+	default:
+		b.failed(i, err)
+	}
+
+	b.mu.Lock()
+	b.states[i].probed = false
+	b.mu.Unlock()
+}
+
+// Close stops probing ejected remotes, and waits for probes in flight to
+// return. Connections open through b are not closed.
+func (b *Balancer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.mu.Unlock()
+
+	b.probing.Wait()
+	return nil
+}
@@ -0,0 +1,107 @@
+package local
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// remoteState returns a copy of the state of remote i of b.
+func (b *Balancer) remoteState(i int) remoteState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.states[i]
+}
+
+// waitFor polls cond until it holds, failing t after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerProbe(t *testing.T) {
+	// reserve a port for a remote that's down for now
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	down := &Dialer{Host: "127.0.0.1", Port: uint16(ln.Addr().(*net.TCPAddr).Port), Crypto: testCrypto, MaxBackoff: 10 * time.Millisecond}
+	b := &Balancer{
+		Remotes:     []*Dialer{down, startRemote(t, false)},
+		MaxFailures: 1,
+		EjectTime:   50 * time.Millisecond,
+	}
+	defer b.Close()
+
+	conn, err := b.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if b.remoteState(0).ejectedAt.IsZero() {
+		t.Fatal("remote down not ejected")
+	}
+
+	// probed in the background, and ejected again, without dialing
+	waitFor(t, "a failed probe", func() bool { return b.remoteState(0).failures > 1 })
+	if b.remoteState(0).ejectedAt.IsZero() {
+		t.Fatal("remote failing probes brought back")
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveRemote(t, ln, false)
+
+	waitFor(t, "the remote brought back", func() bool { return b.remoteState(0).ejectedAt.IsZero() })
+
+	b.Close()
+	for i := range b.Remotes {
+		if st := b.remoteState(i); st.conns != 0 || st.probed {
+			t.Fatalf("remote %d left with %+v", i, st)
+		}
+	}
+}
+
+func TestBalancerCloseStopsProbing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	down := &Dialer{Host: "127.0.0.1", Port: uint16(ln.Addr().(*net.TCPAddr).Port), Crypto: testCrypto, MaxBackoff: 10 * time.Millisecond}
+	b := &Balancer{Remotes: []*Dialer{down}, MaxFailures: 1, EjectTime: 10 * time.Millisecond}
+
+	// not started before the first dial
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b.cancel != nil {
+		t.Fatal("probing started by Close")
+	}
+
+	b = &Balancer{Remotes: []*Dialer{down}, MaxFailures: 1, EjectTime: 10 * time.Millisecond}
+	if _, err := b.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("dialed through a remote that's down")
+	}
+	b.Close()
+
+	failures := b.remoteState(0).failures
+	time.Sleep(50 * time.Millisecond)
+	if n := b.remoteState(0).failures; n != failures {
+		t.Fatalf("probed %d times after Close", n-failures)
+	}
+}
@@ -0,0 +1,217 @@
+// Package local implements the local side of a groundhog tunnel. It serves
+// plain SOCKS5 clients, e.g. browsers, and relays their traffic through an
+// encrypted connection to a groundhog remote, i.e. a SOCKS5 server with
+// socks5.Config.Crypto and socks5.Config.Tunnel set, which does the real
+// dialing.
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tabjy/groundhog/common"
+	"github.com/tabjy/groundhog/common/crypto"
+	"github.com/tabjy/groundhog/common/protocol"
+	"github.com/tabjy/groundhog/common/tcp"
+	"github.com/tabjy/groundhog/socks5"
+	"github.com/tabjy/yagl"
+)
+
+// Dialer implements common.Dialer by connecting to destinations through a
+// groundhog remote. Destination addresses, including domain names, are sent
+// over the encrypted connection, so they are resolved by the remote.
+//
+// Inside the encrypted connection, the destination address is written first,
+// encoded as DST.ADDR and DST.PORT of a SOCKS5 request, i.e. ATYP, followed by
+// a 4-byte IPv4 address, a 1-byte length and a domain name, or a 16-byte IPv6
+// address, and a 2-byte port in network byte order. The remote replies with a
+// single REP byte of SOCKS5 after dialing, 0x00 on success. Data is relayed
+// afterwards in both directions.
+//
+//	local                                           remote
+//	+------+----------+----------+
+//	| ATYP | DST.ADDR | DST.PORT |  ----------->
+//	+------+----------+----------+
+//	|  1   | Variable |    2     |
+//	+------+----------+----------+
+//	                                  +-----+
+//	                  <-------------  | REP |
+//	                                  +-----+
+//	                                  |  1  |
+//	                                  +-----+
+//
+// The remote must have socks5.Config.Tunnel set.
+type Dialer struct {
+	Host string // hostname or IP address of the remote
+	Port uint16 // port of the remote
+
+	// Crypto is called for each connection to the remote, and the connection
+	// is wrapped with Plaintext of the returned EncryptDecrypter. It must
+	// match Crypto of the remote, and return a fresh EncryptDecrypter every
+	// time.
+	Crypto func() (crypto.EncryptDecrypter, error)
+
+	// Forward dials the remote. If nil, net.Dialer would be used.
+	Forward common.Dialer
+
+	// PoolSize, if positive, makes destinations dialed as yamux streams
+	// multiplexed over up to PoolSize long-lived connections to the remote,
+	// instead of a connection each. The remote must have
+	// socks5.Config.Multiplex set as well.
+	PoolSize int
+
+	// IdleTimeout closes a pooled connection once it carries no streams for
+	// that long. If 0, pooled connections are kept until they fail.
+	IdleTimeout time.Duration
+
+	// Once dialing the remote fails, it's retried with exponential backoff and
+	// jitter, up to MaxBackoff between attempts, or DefaultMaxBackoff if 0.
+	// A destination being dialed waits for up to MaxRetries retries, and fails
+	// with "general server failure" after that, or right away while the remote
+	// is backing off if MaxRetries is 0.
+	MaxRetries int
+	MaxBackoff time.Duration
+
+	// Logger specifies an optional logger for reconnection attempts.
+	// If nil, logging goes to os.Stderr via a yagl standard logger.
+	Logger yagl.Logger
+
+	mu       sync.Mutex
+	sessions []*session
+	dialing  int        // sessions being dialed
+	dialed   *sync.Cond // signaled once dialing a session finishes
+
+	// reconnection state, guarded by mu
+	failures int       // consecutive failures dialing the remote
+	lastErr  error     // last failure dialing the remote
+	retryAt  time.Time // when the remote may be dialed again
+}
+
+// Dial implements Dial in common.Dialer.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext implements DialContext in common.Dialer. Only TCP networks are
+// supported.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	req, err := marshalRequest(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return request(ctx, conn, req)
+}
+
+// marshalRequest encodes address as the destination address sent to the
+// remote.
+func marshalRequest(network, address string) ([]byte, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("local: unsupported network %s", network)
+	}
+
+	dst, err := protocol.NewAddrFromString(address)
+	if err != nil {
+		return nil, err
+	}
+	return dst.Marshal()
+}
+
+// open returns a connection to the remote for a destination, which is a yamux
+// stream if PoolSize is positive.
+func (d *Dialer) open(ctx context.Context) (net.Conn, error) {
+	if d.PoolSize > 0 {
+		return d.openStream(ctx)
+	}
+	return d.dialRemote(ctx)
+}
+
+// request sends req over conn to the remote, and returns conn once the remote
+// replies that the destination is dialed. conn is closed on failures.
+func request(ctx context.Context, conn net.Conn, req []byte) (net.Conn, error) {
+	// unblock reads and writes below once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rep := make([]byte, 1)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if rep[0] != protocol.RepSucceeded {
+		conn.Close()
+		return nil, protocol.RepToErr(rep[0])
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialOnce dials the remote, and wraps the connection with encryption.
+func (d *Dialer) dialOnce(ctx context.Context) (net.Conn, error) {
+	ed, err := d.Crypto()
+	if err != nil {
+		return nil, err
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", d.addr())
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := ed.Plaintext(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+func (d *Dialer) addr() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port)))
+}
+
+// NewServer returns a SOCKS5 server as of socks5.NewServer, relaying through
+// remote, a Dialer or a Balancer. Dialer, RemoteDNS, and
+// AllowPrivateDestinations of config are overridden, so that destinations are
+// dialed and resolved by the remote, which decides what it lets clients reach,
+// instead of being checked against the network the local server runs in.
+func NewServer(config *socks5.Config, remote common.Dialer) (*tcp.Server, error) {
+	c := *config
+	c.Dialer = remote
+	c.RemoteDNS = true
+	c.AllowPrivateDestinations = true
+	return socks5.NewServer(&c)
+}
@@ -0,0 +1,157 @@
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tabjy/groundhog/common/crypto"
+	"github.com/tabjy/groundhog/socks5"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func testCrypto() (crypto.EncryptDecrypter, error) {
+	return &crypto.AEADEncryptDecrypter{
+		EncryptKey: append([]byte(nil), testKey...),
+		DecryptKey: append([]byte(nil), testKey...),
+		AEAD:       crypto.NewAESGCM,
+	}, nil
+}
+
+// startRemote serves a groundhog remote on loopback until t is done, and
+// returns a Dialer of it.
+func startRemote(t testing.TB, multiplex bool) *Dialer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveRemote(t, ln, multiplex)
+}
+
+// serveRemote serves a remote on ln until t is done, and returns a Dialer of
+// it.
+func serveRemote(t testing.TB, ln net.Listener, multiplex bool) *Dialer {
+	t.Helper()
+
+	srv, err := socks5.NewServer(&socks5.Config{
+		Port:                     1, // only validated, as the listener is passed in
+		AllowPrivateDestinations: true,
+		Crypto:                   testCrypto,
+		Tunnel:                   true,
+		Multiplex:                multiplex,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeListener(ln)
+
+	return &Dialer{Host: "127.0.0.1", Port: uint16(ln.Addr().(*net.TCPAddr).Port), Crypto: testCrypto}
+}
+
+// echoServer echoes everything back on loopback until t is done.
+func echoServer(t testing.TB) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// checkEcho returns an error unless data written to conn is echoed back.
+func checkEcho(conn net.Conn) error {
+	if _, err := conn.Write([]byte("groundhog")); err != nil {
+		return err
+	}
+	buf := make([]byte, len("groundhog"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != "groundhog" {
+		return fmt.Errorf("echoed %q, want \"groundhog\"", buf)
+	}
+	return nil
+}
+
+func TestDialerTunnel(t *testing.T) {
+	echo := echoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	for _, multiplex := range []bool{false, true} {
+		d := startRemote(t, multiplex)
+		if multiplex {
+			d.PoolSize = 1
+		}
+
+		// the destination address is sent as an IPv4 address and as a domain
+		// name, resolved by the remote
+		for _, address := range []string{echo, net.JoinHostPort("localhost", port)} {
+			conn, err := d.Dial("tcp", address)
+			if err != nil {
+				t.Fatalf("multiplex %v: %v", multiplex, err)
+			}
+			if err := checkEcho(conn); err != nil {
+				t.Fatalf("multiplex %v: %v", multiplex, err)
+			}
+			conn.Close()
+		}
+
+		// dialing a closed port is replied with a failure by the remote
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		if conn, err := d.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+			t.Fatalf("multiplex %v: dialing a closed port succeeded", multiplex)
+		}
+	}
+}
+
+func TestNewServerPrivateDestination(t *testing.T) {
+	echo := echoServer(t)
+
+	// private destinations are left for the remote to check
+	srv, err := NewServer(&socks5.Config{Port: 1, AllowNoAuth: true}, startRemote(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.ServeListener(ln)
+
+	conn, err := socks5.Dial(ln.Addr().String(), "tcp", echo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := checkEcho(conn); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,170 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// session is a pooled connection to the remote.
+type session struct {
+	*yamux.Session
+
+	streams int         // streams open, guarded by Dialer.mu
+	idle    *time.Timer // closes the session once idle, guarded by Dialer.mu
+}
+
+// stream is a yamux stream which releases its session once closed.
+type stream struct {
+	*yamux.Stream
+
+	dialer  *Dialer
+	session *session
+	once    sync.Once
+}
+
+func (s *stream) Close() error {
+	s.once.Do(func() {
+		s.dialer.release(s.session)
+	})
+	return s.Stream.Close()
+}
+
+// openStream opens a stream to the remote on the least busy pooled session. A
+// new session is dialed instead if all are busy, and the pool is not full
+// counting sessions being dialed. If the pool is only full of sessions being
+// dialed, it waits for them, so that a burst of streams at startup never
+// dials more than PoolSize sessions.
+func (d *Dialer) openStream(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+
+	var sess *session
+	for {
+		sess = nil
+		for _, s := range d.sessions {
+			if sess == nil || s.streams < sess.streams {
+				sess = s
+			}
+		}
+
+		if (sess == nil || sess.streams > 0) && len(d.sessions)+d.dialing < d.PoolSize {
+			d.dialing++
+			d.mu.Unlock()
+			s, err := d.dialSession(ctx)
+			d.mu.Lock()
+			d.dialing--
+			d.dialedCond().Broadcast()
+			if err != nil {
+				d.mu.Unlock()
+				return nil, err
+			}
+			d.sessions = append(d.sessions, s)
+			sess = s
+			break
+		}
+
+		if sess != nil {
+			break
+		}
+
+		// every session of the pool is being dialed
+		d.dialedCond().Wait()
+		if err := ctx.Err(); err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	st, err := sess.OpenStream()
+	if err != nil {
+		d.removeLocked(sess)
+		d.mu.Unlock()
+		sess.Close()
+		return nil, err
+	}
+
+	sess.streams++
+	if sess.idle != nil {
+		sess.idle.Stop()
+		sess.idle = nil
+	}
+	d.mu.Unlock()
+
+	return &stream{Stream: st, dialer: d, session: sess}, nil
+}
+
+// dialSession dials the remote, and starts a yamux session over it.
+func (d *Dialer) dialSession(ctx context.Context) (*session, error) {
+	conn, err := d.dialRemote(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+
+	s, err := yamux.Client(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sess := &session{Session: s}
+	go func() {
+		// drop the session from the pool once it fails
+		<-s.CloseChan()
+		d.mu.Lock()
+		d.removeLocked(sess)
+		d.mu.Unlock()
+	}()
+	return sess, nil
+}
+
+// release is called once a stream of sess is closed, and closes sess after
+// IdleTimeout if no other stream is opened meanwhile.
+func (d *Dialer) release(sess *session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sess.streams--
+	if sess.streams > 0 || d.IdleTimeout <= 0 {
+		return
+	}
+
+	var idle *time.Timer
+	idle = time.AfterFunc(d.IdleTimeout, func() {
+		d.mu.Lock()
+		if sess.idle != idle {
+			// a stream was opened meanwhile
+			d.mu.Unlock()
+			return
+		}
+		d.removeLocked(sess)
+		d.mu.Unlock()
+		sess.Close()
+	})
+	sess.idle = idle
+}
+
+// dialedCond returns the condition signaled once dialing a session finishes.
+// d.mu must be held.
+func (d *Dialer) dialedCond() *sync.Cond {
+	if d.dialed == nil {
+		d.dialed = sync.NewCond(&d.mu)
+	}
+	return d.dialed
+}
+
+// removeLocked removes sess from the pool. d.mu must be held.
+func (d *Dialer) removeLocked(sess *session) {
+	for i, s := range d.sessions {
+		if s == sess {
+			d.sessions = append(d.sessions[:i], d.sessions[i+1:]...)
+			return
+		}
+	}
+}
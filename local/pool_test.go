@@ -0,0 +1,66 @@
+package local
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowDialer dials after a delay, counting dials, so that streams opened at
+// once all find their sessions still being dialed.
+type slowDialer struct {
+	dials atomic.Int32
+}
+
+func (d *slowDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *slowDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestPoolBurst(t *testing.T) {
+	echo := echoServer(t)
+	forward := &slowDialer{}
+
+	d := startRemote(t, true)
+	d.PoolSize = 2
+	d.Forward = forward
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := d.Dial("tcp", echo)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			if err := checkEcho(conn); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := forward.dials.Load(); n > int32(d.PoolSize) {
+		t.Fatalf("%d sessions dialed, want at most %d", n, d.PoolSize)
+	}
+
+	d.mu.Lock()
+	n := len(d.sessions)
+	d.mu.Unlock()
+	if n > d.PoolSize {
+		t.Fatalf("%d sessions pooled, want at most %d", n, d.PoolSize)
+	}
+}
@@ -0,0 +1,99 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/tabjy/yagl"
+)
+
+// DefaultMaxBackoff is the longest delay between attempts to dial the remote
+// if Dialer.MaxBackoff is 0.
+const DefaultMaxBackoff = 30 * time.Second
+
+// minBackoff is the delay after the first failure dialing the remote, doubled
+// on every consecutive failure.
+const minBackoff = 100 * time.Millisecond
+
+// dialRemote dials the remote as of dialOnce, retrying with backoff on
+// failures, see Dialer.MaxRetries.
+func (d *Dialer) dialRemote(ctx context.Context) (net.Conn, error) {
+	for retries := 0; ; retries++ {
+		d.mu.Lock()
+		wait, lastErr := time.Until(d.retryAt), d.lastErr
+		d.mu.Unlock()
+
+		if wait > 0 {
+			if retries >= d.MaxRetries {
+				return nil, fmt.Errorf("general server failure: remote %s unavailable: %v", d.addr(), lastErr)
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		conn, err := d.dialOnce(ctx)
+		if err == nil {
+			d.connected()
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d.disconnected(err)
+	}
+}
+
+// connected resets the backoff once the remote is dialed.
+func (d *Dialer) connected() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.failures > 0 {
+		d.logger().Infof("reconnected to remote %s after %d failed attempts", d.addr(), d.failures)
+	}
+	d.failures = 0
+	d.lastErr = nil
+	d.retryAt = time.Time{}
+}
+
+// disconnected backs off after failing to dial the remote with err.
+func (d *Dialer) disconnected(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failures++
+	d.lastErr = err
+
+	maxBackoff := d.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	backoff := maxBackoff
+	if d.failures < 32 { // don't overflow
+		if b := minBackoff << uint(d.failures-1); b > 0 && b < maxBackoff {
+			backoff = b
+		}
+	}
+	// jitter in [backoff/2, backoff], so that locals don't retry in lockstep
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	d.retryAt = time.Now().Add(backoff)
+
+	d.logger().Warnf("failed to connect to remote %s (attempt %d), retrying in %v: %v", d.addr(), d.failures, backoff, err)
+}
+
+func (d *Dialer) logger() yagl.Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return yagl.StdLogger()
+}
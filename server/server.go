@@ -351,7 +351,7 @@ func (g *gndhog) reply(err error) error {
 		case protocol.CipherAES256CFB, protocol.CipherAES256CTR, protocol.CipherAES256OFB:
 			keyLen = 32 // 192/8
 		default:
-			fmt.Errorf("unsupported cipher method %#x", g.clientCipher)
+			return fmt.Errorf("unsupported cipher method %#x", g.clientCipher)
 		}
 
 		if keyLen > 0 {
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// Action of an ACL rule.
+type Action byte
+
+// Actions of ACL rules.
+const (
+	Allow Action = iota
+	Deny
+)
+
+// Rule matches destinations by either IP network or domain name pattern.
+type Rule struct {
+	Action Action
+
+	Network *net.IPNet // Matches destination IP addresses in Network, if set.
+	Domain  string     // Matches destination domain names by glob pattern (e.g. "*.example.com"), if set.
+}
+
+// ParseRule parses a rule of form "ACTION TARGET", where ACTION is "allow" or
+// "deny", and TARGET is a CIDR (e.g. "10.0.0.0/8"), an IP address, or a
+// domain name pattern (e.g. "*.example.com").
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Rule{}, fmt.Errorf("malformed ACL rule %q, want \"allow|deny TARGET\"", s)
+	}
+
+	var rule Rule
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return Rule{}, fmt.Errorf("unknown ACL action %q in rule %q", fields[0], s)
+	}
+
+	target := fields[1]
+	if _, network, err := net.ParseCIDR(target); err == nil {
+		rule.Network = network
+	} else if ip := net.ParseIP(target); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		if _, err := path.Match(target, ""); err != nil {
+			return Rule{}, fmt.Errorf("malformed domain pattern in rule %q: %v", s, err)
+		}
+		rule.Domain = strings.ToLower(target)
+	}
+
+	return rule, nil
+}
+
+// match reports whether the rule matches a destination with domain name
+// domain and IP address ip, either of which could be empty.
+func (r *Rule) match(domain string, ip net.IP) bool {
+	if r.Network != nil {
+		return ip != nil && r.Network.Contains(ip)
+	}
+
+	matched, _ := path.Match(r.Domain, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	return domain != "" && matched
+}
+
+// ACL decides which destinations clients are allowed to connect to. Rules are
+// evaluated in order, and the first matching rule decides. If none matches,
+// Default decides. The zero value for ACL allows everything.
+type ACL struct {
+	Rules   []Rule
+	Default Action
+}
+
+// ParseACL parses rules with ParseRule into an ACL.
+func ParseACL(rules []string, def Action) (*ACL, error) {
+	acl := &ACL{Default: def}
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl, nil
+}
+
+// Allowed reports whether dst is allowed. resolved is dst with its domain name
+// resolved, if known, so that IP network rules apply to domain names as well.
+func (acl *ACL) Allowed(dst, resolved *protocol.Addr) bool {
+	ip := dst.IP
+	if ip == nil && resolved != nil {
+		ip = resolved.IP
+	}
+
+	for i := range acl.Rules {
+		if acl.Rules[i].match(dst.Domain, ip) {
+			return acl.Rules[i].Action == Allow
+		}
+	}
+	return acl.Default == Allow
+}
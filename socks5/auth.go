@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// Version of username/password sub-negotiation, as of RFC1929.
+const userPassVer byte = 0x01
+
+// Authenticator authenticates SOCKS clients with one authentication method.
+type Authenticator interface {
+	// Method returns METHOD byte advertised in method negotiation.
+	Method() byte
+
+	// Authenticate runs method-specific sub-negotiation over conn, after the
+	// method has been selected. It returns ctx, optionally carrying identity
+	// of the client, which is passed on to request handling.
+	Authenticate(ctx context.Context, conn net.Conn) (context.Context, error)
+}
+
+// NoAuthAuthenticator is an Authenticator for NO AUTHENTICATION REQUIRED.
+type NoAuthAuthenticator struct{}
+
+// Method implements Authenticator.
+func (a NoAuthAuthenticator) Method() byte {
+	return methodNoAuth
+}
+
+// Authenticate implements Authenticator. It always succeeds.
+func (a NoAuthAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (context.Context, error) {
+	return ctx, nil
+}
+
+// Version of GSSAPI message framing, as of RFC1961.
+const gssapiVer byte = 0x01
+
+// GSSAPIAuthenticator is a stub Authenticator for GSSAPI, as of RFC1961,
+// which is not supported yet. Clients offering GSSAPI along with methods of
+// other Authenticators are served with those regardless, but clients offering
+// GSSAPI only are rejected with 0xFF, NO ACCEPTABLE METHODS. Listing
+// GSSAPIAuthenticator last in Config.Authenticators makes them rejected by a
+// GSSAPI failure message instead, which such clients may report better.
+type GSSAPIAuthenticator struct{}
+
+// Method implements Authenticator.
+func (a GSSAPIAuthenticator) Method() byte {
+	return methodGSSAPI
+}
+
+// Authenticate implements Authenticator. It always fails, replying to the
+// client with a GSSAPI message of type 0xFF, i.e. refused.
+func (a GSSAPIAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (context.Context, error) {
+	conn.Write([]byte{gssapiVer, 0xFF})
+	return nil, errors.New("GSSAPI authentication is unsupported")
+}
+
+// UserPassAuthenticator is an Authenticator for username/password, as of
+// RFC1929. The username of an authenticated client can be retrieved with
+// UsernameFromContext.
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+// Method implements Authenticator.
+func (a UserPassAuthenticator) Method() byte {
+	return methodUserPass
+}
+
+// Authenticate implements Authenticator. The client sends VER, ULEN, UNAME,
+// PLEN, and PASSWD, to which the server replies VER and STATUS, 0x00 for
+// success.
+func (a UserPassAuthenticator) Authenticate(ctx context.Context, conn net.Conn) (context.Context, error) {
+	ver := []byte{0}
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return nil, err
+	}
+
+	if ver[0] != userPassVer {
+		return nil, fmt.Errorf("unsupported username/password auth version: %#x", ver[0])
+	}
+
+	username, err := readUserPassField(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := readUserPassField(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.Credentials.Valid(username, password) {
+		conn.Write([]byte{userPassVer, 0x01})
+		return nil, fmt.Errorf("invalid credentials for user %q", username)
+	}
+
+	if _, err := conn.Write([]byte{userPassVer, 0x00}); err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, usernameKey{}, username), nil
+}
+
+// readUserPassField reads a length-prefixed UNAME or PASSWD.
+func readUserPassField(r io.Reader) (string, error) {
+	fieldLen := []byte{0}
+	if _, err := io.ReadFull(r, fieldLen); err != nil {
+		return "", err
+	}
+
+	if fieldLen[0] == 0 {
+		return "", errors.New("empty username/password field")
+	}
+
+	field := make([]byte, int(fieldLen[0]))
+	if _, err := io.ReadFull(r, field); err != nil {
+		return "", err
+	}
+
+	return string(field), nil
+}
+
+type usernameKey struct{}
+
+// UsernameFromContext returns username of a client authenticated by
+// UserPassAuthenticator, from ctx passed to request handling.
+func UsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(usernameKey{}).(string)
+	return username, ok
+}
+
+// CredentialStore checks username/password credentials presented by SOCKS
+// clients.
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// StaticCredentials is a CredentialStore backed by a map from usernames to
+// passwords.
+type StaticCredentials map[string]string
+
+// Valid implements CredentialStore. Passwords are compared in constant time.
+func (c StaticCredentials) Valid(username, password string) bool {
+	want, ok := c[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// bufferedConn is a net.Conn reading from r, which buffers the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return util.CloseWrite(c.Conn)
+}
@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUserPassAuthenticator(t *testing.T) {
+	auth := UserPassAuthenticator{Credentials: StaticCredentials{"user": "password"}}
+
+	for _, tt := range []struct {
+		name  string
+		req   []byte
+		reply []byte // nil if none is expected
+		ok    bool
+	}{
+		{"valid", []byte("\x01\x04user\x08password"), []byte{userPassVer, 0x00}, true},
+		{"wrong password", []byte("\x01\x04user\x05wrong"), []byte{userPassVer, 0x01}, false},
+		{"unknown user", []byte("\x01\x05other\x08password"), []byte{userPassVer, 0x01}, false},
+		{"zero ULEN", []byte("\x01\x00\x08password"), nil, false},
+		{"zero PLEN", []byte("\x01\x04user\x00"), nil, false},
+		{"SOCKS version", []byte("\x05\x04user\x08password"), nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+
+			replyc := make(chan []byte, 1)
+			go func() {
+				client.Write(tt.req)
+				reply, _ := io.ReadAll(client)
+				replyc <- reply
+			}()
+
+			ctx, err := auth.Authenticate(context.Background(), server)
+			server.Close()
+
+			if tt.ok != (err == nil) {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if reply := <-replyc; string(reply) != string(tt.reply) {
+				t.Fatalf("reply %x, want %x", reply, tt.reply)
+			}
+			if tt.ok {
+				if username, _ := UsernameFromContext(ctx); username != "user" {
+					t.Fatalf("username %q in context, want \"user\"", username)
+				}
+			}
+		})
+	}
+}
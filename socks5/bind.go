@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// DefaultBindTimeout is how long a BIND request waits for an inbound
+// connection if Config.BindTimeout is 0.
+const DefaultBindTimeout = 2 * time.Minute
+
+// handleBind serves a BIND request, as of RFC1928 section 4. A listener is
+// bound on the same IP address client connected to, or s.outboundIP if set,
+// and its address is sent in the first reply. Once an inbound connection is
+// accepted, its address is sent in the second reply, and data is relayed
+// between it and the client.
+//
+// If DST.ADDR is an IP address, inbound connections from any other IP address
+// are closed, and waiting goes on. DST.PORT isn't checked, as clients tend to
+// send the port of another connection to the application server, e.g. FTP
+// control, if any. DST.ADDR being unspecified, e.g. 0.0.0.0, or a domain name
+// lets any peer connect.
+func (s *socks) handleBind(ctx context.Context) error {
+	ip := s.local.IP
+	if s.outboundIP != nil {
+		ip = s.outboundIP
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		s.metrics.IncErrors("bind")
+		s.reply(err, s.local)
+		return err
+	}
+	defer ln.Close()
+
+	bnd := &protocol.Addr{
+		IP:   ip,
+		Port: uint16(ln.Addr().(*net.TCPAddr).Port),
+	}
+	if err := s.reply(nil, bnd); err != nil {
+		return err
+	}
+
+	s.logger.Tracef("BIND for %s listening on %s", s.client.RemoteAddr(), ln.Addr())
+
+	timeout := s.bindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+
+	// unblock Accept if ctx is done before anything comes in
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	target, err := s.acceptBind(ln)
+	if err != nil {
+		s.metrics.IncErrors("bind")
+		s.reply(err, bnd)
+		return fmt.Errorf("failed to accept inbound connection: %v", err)
+	}
+	ln.Close() // only one inbound connection per BIND
+	s.target = target
+	defer s.target.Close()
+	s.setKeepAlive(s.target)
+
+	peer := &protocol.Addr{
+		IP:   target.RemoteAddr().(*net.TCPAddr).IP,
+		Port: uint16(target.RemoteAddr().(*net.TCPAddr).Port),
+	}
+	if err := s.reply(nil, peer); err != nil {
+		return err
+	}
+
+	s.logger.Tracef("BIND for %s accepted %s", s.client.RemoteAddr(), peer)
+
+	return s.relay(ctx)
+}
+
+// acceptBind accepts the first inbound connection on ln from DST.ADDR of the
+// BIND request, see handleBind.
+func (s *socks) acceptBind(ln *net.TCPListener) (*net.TCPConn, error) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP
+		if s.dst.IP == nil || s.dst.IP.IsUnspecified() || s.dst.IP.Equal(ip) {
+			return conn, nil
+		}
+
+		s.logger.Tracef("BIND for %s expects %s, closing inbound connection from %s", s.client.RemoteAddr(), s.dst.IP, ip)
+		conn.Close()
+	}
+}
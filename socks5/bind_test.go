@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+func TestBindChecksPeer(t *testing.T) {
+	// 127.0.0.2 is as much loopback as 127.0.0.1 on Linux, but not everywhere
+	expected := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	probe, err := net.ListenTCP("tcp", expected)
+	if err != nil {
+		t.Skipf("127.0.0.2 not usable: %v", err)
+	}
+	probe.Close()
+
+	addr := startTestServer(t, &Config{AllowedCommands: CommandConnect | CommandBind})
+	conn := dialTestServer(t, addr)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	writeRequest(t, conn, cmdBind, &protocol.Addr{IP: expected.IP, Port: 21})
+	bnd := readReply(t, conn, 0x00)
+
+	// from 127.0.0.1, i.e. not DST.ADDR
+	other, err := net.DialTCP("tcp", nil, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read from unexpected peer returned %v, want io.EOF", err)
+	}
+
+	peer, err := net.DialTCP("tcp", expected, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if got := readReply(t, conn, 0x00); !got.IP.Equal(expected.IP) || got.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("second reply %v, want %v", got, peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("groundhog")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("groundhog"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "groundhog" {
+		t.Fatalf("relayed %q, want %q", got, "groundhog")
+	}
+}
@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// CloseReason tells why a client connection is closed, as reported in Reason
+// of an EventClosed Event.
+type CloseReason int
+
+// Reasons of closing a client connection.
+const (
+	CloseClientEOF   CloseReason = iota // The client closed the connection first.
+	CloseServerEOF                      // The destination closed the connection first.
+	CloseIdleTimeout                    // No data was relayed for IdleTimeout.
+	CloseDeadline                       // A deadline was hit before relaying, e.g. HandshakeTimeout.
+	CloseACL                            // The request was denied by ACL or OnConnect.
+	CloseError                          // Anything else went wrong, see Err.
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseClientEOF:
+		return "client EOF"
+	case CloseServerEOF:
+		return "server EOF"
+	case CloseIdleTimeout:
+		return "idle timeout"
+	case CloseDeadline:
+		return "deadline"
+	case CloseACL:
+		return "acl"
+	case CloseError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// closeReason returns why the connection is closed after being served with
+// err. s.reason is set where it's known better than err tells, i.e. by relay
+// and on requests denied, and is left as CloseClientEOF otherwise.
+func (s *socks) closeReason(err error) CloseReason {
+	switch {
+	case err == nil || s.reason != CloseClientEOF:
+		return s.reason
+	case isTimeout(err):
+		return CloseDeadline
+	default:
+		return CloseError
+	}
+}
+
+// eofRecorder records which side of a relay reaches EOF first.
+type eofRecorder struct {
+	once   sync.Once
+	seen   bool
+	reason CloseReason
+}
+
+// eofConn reports to rec if EOF is read from it, with reason.
+type eofConn struct {
+	net.Conn
+	rec    *eofRecorder
+	reason CloseReason
+}
+
+func (c *eofConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		c.eof()
+	}
+	return n, err
+}
+
+// ReadFrom copies from r into the wrapped net.Conn with io.Copy, unwrapping r
+// if it's an eofConn, so that io.Copy between two eofConns wrapping TCP
+// connections is spliced, see relay.
+func (c *eofConn) ReadFrom(r io.Reader) (int64, error) {
+	src, ok := r.(*eofConn)
+	if !ok {
+		return io.Copy(c.Conn, r)
+	}
+
+	n, err := io.Copy(c.Conn, src.Conn)
+	if err == nil {
+		src.eof()
+	}
+	return n, err
+}
+
+func (c *eofConn) eof() {
+	c.rec.once.Do(func() {
+		c.rec.seen = true
+		c.rec.reason = c.reason
+	})
+}
+
+func (c *eofConn) CloseWrite() error {
+	return util.CloseWrite(c.Conn)
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// wrappedConn hides everything of a net.Conn but net.Conn itself, e.g.
+// ReadFrom of *net.TCPConn.
+type wrappedConn struct {
+	net.Conn
+}
+
+// tcpPair returns both ends of a loopback TCP connection, closed once t is
+// done.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	conn, err := net.DialTCP("tcp", nil, tcpServer(t, accepted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+func TestEOFConnReadFrom(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("splice is only used on Linux")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		wrap    func(net.Conn) net.Conn
+		spliced bool
+	}{
+		{"TCP", func(conn net.Conn) net.Conn { return conn }, true},
+		{"wrapped", func(conn net.Conn) net.Conn { return wrappedConn{conn} }, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, clientPeer := tcpPair(t)
+			target, targetPeer := tcpPair(t)
+
+			var rec eofRecorder
+			src := &eofConn{Conn: tt.wrap(clientPeer), rec: &rec, reason: CloseClientEOF}
+			dst := &eofConn{Conn: tt.wrap(target), rec: &rec, reason: CloseServerEOF}
+
+			const size = 4 << 20
+			data := make([]byte, size)
+			go func() {
+				client.Write(data)
+				client.(*net.TCPConn).CloseWrite()
+			}()
+
+			readc := make(chan int, 1)
+			buf := make([]byte, 64*1024)
+			go func() {
+				read := 0
+				for {
+					n, err := targetPeer.Read(buf)
+					read += n
+					if err != nil {
+						readc <- read
+						return
+					}
+				}
+			}()
+
+			// copying in user space allocates a buffer of its own, while
+			// splicing moves the data in the kernel
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			n, err := io.Copy(dst, src)
+			runtime.ReadMemStats(&after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target.(*net.TCPConn).CloseWrite()
+
+			if n != size {
+				t.Fatalf("copied %d bytes, want %d", n, size)
+			}
+			if read := <-readc; read != size {
+				t.Fatalf("read %d bytes, want %d", read, size)
+			}
+			if !rec.seen || rec.reason != CloseClientEOF {
+				t.Fatalf("recorded EOF %v of %v, want %v", rec.seen, rec.reason, CloseClientEOF)
+			}
+
+			allocated := after.TotalAlloc - before.TotalAlloc
+			if spliced := allocated < 32*1024; spliced != tt.spliced {
+				t.Fatalf("allocated %d bytes copying, spliced %v, want %v", allocated, spliced, tt.spliced)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Commands is a set of SOCKS commands, see Config.AllowedCommands.
+type Commands uint8
+
+// SOCKS commands, to be combined with |.
+const (
+	CommandConnect Commands = 1 << iota
+	CommandBind
+	CommandUDPAssociate
+)
+
+// DefaultAllowedCommands are the commands allowed if Config.AllowedCommands is
+// 0.
+const DefaultAllowedCommands = CommandConnect
+
+var commandNames = []struct {
+	command Commands
+	cmd     byte
+	name    string
+}{
+	{CommandConnect, cmdConnect, "connect"},
+	{CommandBind, cmdBind, "bind"},
+	{CommandUDPAssociate, cmdUDPAssociate, "udp_associate"},
+}
+
+// ParseCommands parses names of commands, "connect", "bind", or
+// "udp_associate", case-insensitive, into Commands.
+func ParseCommands(names []string) (Commands, error) {
+	var commands Commands
+	for _, name := range names {
+		found := false
+		for _, c := range commandNames {
+			if strings.EqualFold(name, c.name) {
+				commands |= c.command
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown SOCKS command %q", name)
+		}
+	}
+	return commands, nil
+}
+
+// allows tells if cmd, as sent in a request, is in c.
+func (c Commands) allows(cmd byte) bool {
+	for _, n := range commandNames {
+		if n.cmd == cmd {
+			return c&n.command != 0
+		}
+	}
+	return false
+}
+
+// String implements String function of Stringer interface.
+func (c Commands) String() string {
+	var names []string
+	for _, n := range commandNames {
+		if c&n.command != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
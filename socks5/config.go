@@ -0,0 +1,377 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tabjy/groundhog/common/crypto"
+	"github.com/tabjy/groundhog/common/util"
+	"github.com/tabjy/yagl"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the subset of Config which can be loaded from a file. Logger,
+// Dialer, Resolver, and Authenticators have to be set programmatically, and
+// Crypto too, unless it's made of a cipher name and password.
+type fileConfig struct {
+	Host        string            `json:"host" yaml:"host"`
+	Port        uint16            `json:"port" yaml:"port"`
+	PortRange   string            `json:"port_range" yaml:"port_range"`
+	Network     string            `json:"network" yaml:"network"`
+	Listeners   []string          `json:"listeners" yaml:"listeners"`
+	Credentials map[string]string `json:"credentials" yaml:"credentials"`
+	AllowNoAuth bool              `json:"allow_no_auth" yaml:"allow_no_auth"`
+	DialTimeout duration          `json:"dial_timeout" yaml:"dial_timeout"`
+	IdleTimeout duration          `json:"idle_timeout" yaml:"idle_timeout"`
+	BindTimeout duration          `json:"bind_timeout" yaml:"bind_timeout"`
+
+	HandshakeTimeout duration `json:"handshake_timeout" yaml:"handshake_timeout"`
+	KeepAlivePeriod  duration `json:"keep_alive_period" yaml:"keep_alive_period"`
+
+	HappyEyeballs bool `json:"happy_eyeballs" yaml:"happy_eyeballs"`
+	RemoteDNS     bool `json:"remote_dns" yaml:"remote_dns"`
+	EnableSOCKS4  bool `json:"enable_socks4" yaml:"enable_socks4"`
+	ProxyProtocol bool `json:"proxy_protocol" yaml:"proxy_protocol"`
+
+	HTTPConnect bool `json:"http_connect" yaml:"http_connect"`
+
+	OutboundSourceIP string `json:"outbound_source_ip" yaml:"outbound_source_ip"`
+
+	Cipher   string `json:"cipher" yaml:"cipher"`
+	Password string `json:"password" yaml:"password"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+	KeyEnv   string `json:"key_env" yaml:"key_env"`
+
+	AllowedCommands []string `json:"allowed_commands" yaml:"allowed_commands"`
+
+	ACL        []string `json:"acl" yaml:"acl"`
+	ACLDefault string   `json:"acl_default" yaml:"acl_default"`
+
+	AllowPrivateDestinations bool `json:"allow_private_destinations" yaml:"allow_private_destinations"`
+
+	PerConnBytesPerSec int `json:"per_conn_bytes_per_sec" yaml:"per_conn_bytes_per_sec"`
+	TotalBytesPerSec   int `json:"total_bytes_per_sec" yaml:"total_bytes_per_sec"`
+	RelayBufferSize    int `json:"relay_buffer_size" yaml:"relay_buffer_size"`
+
+	RequestsPerSecPerIP float64 `json:"requests_per_sec_per_ip" yaml:"requests_per_sec_per_ip"`
+	RequestBurstPerIP   int     `json:"request_burst_per_ip" yaml:"request_burst_per_ip"`
+
+	MaxConns       int  `json:"max_conns" yaml:"max_conns"`
+	RejectWhenFull bool `json:"reject_when_full" yaml:"reject_when_full"`
+}
+
+// duration is a time.Duration written as a string, e.g. "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %v", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %v", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// LoadConfig reads a Config from a JSON or YAML file at path, told apart by
+// extension (".yaml" or ".yml" for YAML, JSON otherwise). Keys are lowercase,
+// see the example below. Unknown keys are ignored with a warning. If port is
+// missing or 0, a free port is picked, from port_range if set, e.g.
+// "20000-20100". The returned Config is validated with Validate, so unless
+// credentials are set, allow_no_auth must be true. The password for cipher
+// is better kept out of the file, read from key_file, with trailing newlines
+// trimmed, or environment variable key_env, rather than given inline as
+// password.
+//
+//	{
+//		"host": "localhost",
+//		"port": 1080,
+//		"credentials": {"user": "password"},
+//		"acl": ["deny 10.0.0.0/8", "allow *.example.com"],
+//		"acl_default": "allow",
+//		"allowed_commands": ["connect", "bind"],
+//		"handshake_timeout": "10s",
+//		"dial_timeout": "10s",
+//		"idle_timeout": "5m",
+//		"bind_timeout": "2m",
+//		"keep_alive_period": "30s",
+//		"cipher": "aes-256-ctr",
+//		"key_env": "GROUNDHOG_PASSWORD",
+//		"per_conn_bytes_per_sec": 1048576,
+//		"total_bytes_per_sec": 10485760,
+//		"max_conns": 1024,
+//		"reject_when_full": false
+//	}
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, false)
+}
+
+// LoadConfigStrict is like LoadConfig, but unknown keys are errors.
+func LoadConfigStrict(path string) (*Config, error) {
+	return loadConfig(path, true)
+}
+
+// LoadConfigYAML is like LoadConfig, but reads YAML regardless of extension.
+func LoadConfigYAML(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, buf, decodeYAML, false)
+}
+
+func loadConfig(path string, strict bool) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decode := decodeJSON
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decode = decodeYAML
+	}
+
+	return parseConfig(path, buf, decode, strict)
+}
+
+func parseConfig(path string, buf []byte, decode func(buf []byte, fc *fileConfig, strict bool) error, strict bool) (*Config, error) {
+	var fc fileConfig
+	if err := decode(buf, &fc, true); err != nil {
+		if strict {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+
+		// retry ignoring unknown keys, warning if that's all what's wrong
+		fc = fileConfig{}
+		if err := decode(buf, &fc, false); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+		yagl.StdLogger().Warnf("config %s: %v", path, err)
+	}
+
+	config, err := fc.config()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func decodeJSON(buf []byte, fc *fileConfig, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(fc)
+}
+
+func decodeYAML(buf []byte, fc *fileConfig, strict bool) error {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(strict)
+	return dec.Decode(fc)
+}
+
+func (fc *fileConfig) config() (*Config, error) {
+	config := &Config{
+		Host:        fc.Host,
+		Port:        fc.Port,
+		Network:     fc.Network,
+		Listeners:   fc.Listeners,
+		AllowNoAuth: fc.AllowNoAuth,
+		DialTimeout: time.Duration(fc.DialTimeout),
+		IdleTimeout: time.Duration(fc.IdleTimeout),
+		BindTimeout: time.Duration(fc.BindTimeout),
+
+		HandshakeTimeout: time.Duration(fc.HandshakeTimeout),
+		KeepAlivePeriod:  time.Duration(fc.KeepAlivePeriod),
+
+		HappyEyeballs: fc.HappyEyeballs,
+		RemoteDNS:     fc.RemoteDNS,
+		EnableSOCKS4:  fc.EnableSOCKS4,
+		ProxyProtocol: fc.ProxyProtocol,
+
+		HTTPConnect: fc.HTTPConnect,
+
+		OutboundSourceIP: fc.OutboundSourceIP,
+
+		AllowPrivateDestinations: fc.AllowPrivateDestinations,
+
+		PerConnBytesPerSec: fc.PerConnBytesPerSec,
+		TotalBytesPerSec:   fc.TotalBytesPerSec,
+		RelayBufferSize:    fc.RelayBufferSize,
+
+		RequestsPerSecPerIP: fc.RequestsPerSecPerIP,
+		RequestBurstPerIP:   fc.RequestBurstPerIP,
+
+		MaxConns:       fc.MaxConns,
+		RejectWhenFull: fc.RejectWhenFull,
+	}
+
+	if fc.AllowedCommands != nil {
+		commands, err := ParseCommands(fc.AllowedCommands)
+		if err != nil {
+			return nil, err
+		}
+		config.AllowedCommands = commands
+	}
+
+	if fc.ACL != nil || fc.ACLDefault != "" {
+		def := Allow
+		switch strings.ToLower(fc.ACLDefault) {
+		case "", "allow":
+		case "deny":
+			def = Deny
+		default:
+			return nil, fmt.Errorf("unknown ACL default action %q", fc.ACLDefault)
+		}
+
+		acl, err := ParseACL(fc.ACL, def)
+		if err != nil {
+			return nil, err
+		}
+		config.ACL = acl
+	}
+
+	if fc.Credentials != nil {
+		config.Credentials = StaticCredentials(fc.Credentials)
+	}
+
+	if fc.Cipher != "" || fc.Password != "" || fc.KeyFile != "" || fc.KeyEnv != "" {
+		c, err := fc.crypto()
+		if err != nil {
+			return nil, err
+		}
+		config.Crypto = c
+	}
+
+	if config.Port == 0 && config.Network != "unix" {
+		port, err := fc.freePort()
+		if err != nil {
+			return nil, err
+		}
+		config.Port = uint16(port)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// freePort picks a free port from PortRange, or any if PortRange is empty.
+func (fc *fileConfig) freePort() (int, error) {
+	if fc.PortRange == "" {
+		return util.GetFreeTCPPort()
+	}
+
+	bounds := strings.SplitN(fc.PortRange, "-", 2)
+	if len(bounds) != 2 {
+		return 0, fmt.Errorf("invalid port range %q", fc.PortRange)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid port range %q: %v", fc.PortRange, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid port range %q: %v", fc.PortRange, err)
+	}
+	return util.GetFreePortInRange(min, max)
+}
+
+// crypto returns Config.Crypto of Cipher, "aes-256-ctr" if empty, keyed with
+// the password from Password, KeyFile, or KeyEnv, whichever is set, stretched
+// with crypto.KeyFromPassword.
+func (fc *fileConfig) crypto() (func() (crypto.EncryptDecrypter, error), error) {
+	cipher := fc.Cipher
+	if cipher == "" {
+		cipher = "aes-256-ctr"
+	}
+
+	keyLen, mode, err := crypto.ParseCipher(cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := fc.password()
+	if err != nil {
+		return nil, err
+	}
+
+	// stretched once, as it's meant to be slow
+	key, err := crypto.KeyFromPassword(password, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (crypto.EncryptDecrypter, error) {
+		return crypto.NewStreamEncryptDecrypter(key, mode)
+	}, nil
+}
+
+// password returns the password set inline, read from KeyFile with trailing
+// newlines trimmed, or read from environment variable KeyEnv. Exactly one of
+// them must be set.
+func (fc *fileConfig) password() (string, error) {
+	var password string
+	var sources []string
+
+	if fc.Password != "" {
+		password = fc.Password
+		sources = append(sources, "password")
+	}
+
+	if fc.KeyFile != "" {
+		buf, err := ioutil.ReadFile(fc.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key_file: %v", err)
+		}
+		password = strings.TrimRight(string(buf), "\r\n")
+		sources = append(sources, "key_file")
+	}
+
+	if fc.KeyEnv != "" {
+		v, ok := os.LookupEnv(fc.KeyEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s of key_env is not set", fc.KeyEnv)
+		}
+		password = v
+		sources = append(sources, "key_env")
+	}
+
+	switch {
+	case len(sources) == 0:
+		return "", fmt.Errorf("cipher %s requires one of password, key_file, or key_env", fc.Cipher)
+	case len(sources) > 1:
+		return "", fmt.Errorf("only one of password, key_file, or key_env may be set, got %s", strings.Join(sources, ", "))
+	case password == "":
+		return "", fmt.Errorf("empty password from %s", sources[0])
+	}
+	return password, nil
+}
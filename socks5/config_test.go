@@ -0,0 +1,22 @@
+package socks5
+
+import "testing"
+
+func TestParseConfigNegativeRate(t *testing.T) {
+	for _, buf := range []string{
+		`{"port": 1080, "allow_no_auth": true, "per_conn_bytes_per_sec": -1}`,
+		`{"port": 1080, "allow_no_auth": true, "total_bytes_per_sec": -1}`,
+	} {
+		if _, err := parseConfig("config.json", []byte(buf), decodeJSON, true); err == nil {
+			t.Fatalf("%s parsed", buf)
+		}
+	}
+
+	config, err := parseConfig("config.json", []byte(`{"port": 1080, "allow_no_auth": true, "per_conn_bytes_per_sec": 1024}`), decodeJSON, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PerConnBytesPerSec != 1024 {
+		t.Fatalf("PerConnBytesPerSec %d, want 1024", config.PerConnBytesPerSec)
+	}
+}
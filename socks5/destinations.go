@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// DefaultDestinationStatsCapacity is the number of destinations tracked by
+// DestinationStats if Capacity is 0.
+const DefaultDestinationStatsCapacity = 1024
+
+// DestinationStat is traffic to a single destination host, as reported by
+// DestinationStats.TopDestinations.
+type DestinationStat struct {
+	Host  string // domain name or IP address, as requested by clients
+	Conns int64  // requests to Host
+	Bytes int64  // bytes relayed to and from Host, in both directions
+
+	// Error is how much Bytes may be overestimated by, which is nonzero if
+	// Host started being tracked in place of another destination.
+	Error int64
+}
+
+// DestinationStats aggregates traffic by destination host, to tell which
+// destinations consume the most bandwidth, e.g. to spot abuse or heavy
+// tenants. Set it as Config.DestinationStats, and query it with
+// TopDestinations. A request is counted once it's served, with everything
+// relayed for it, so a long-lived connection only shows up once closed.
+//
+// Memory is bounded by Capacity, with the Space-Saving algorithm: once
+// Capacity destinations are tracked, a new destination replaces the one with
+// the least Bytes, and inherits its Bytes as Error. Every destination with
+// more than total bytes / Capacity is then guaranteed to be tracked, with
+// Bytes never underestimated. The zero value is ready to use, and it's safe
+// for concurrent use.
+type DestinationStats struct {
+	Capacity int
+
+	mu    sync.Mutex
+	hosts map[string]*destinationEntry
+	heap  destinationHeap // of hosts, least Bytes first
+}
+
+type destinationEntry struct {
+	DestinationStat
+	index int // in heap
+}
+
+// observe counts a request to host, with bytes relayed for it.
+func (d *DestinationStats) observe(host string, bytes int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.hosts[host]; ok {
+		e.Conns++
+		e.Bytes += bytes
+		heap.Fix(&d.heap, e.index)
+		return
+	}
+
+	if d.hosts == nil {
+		d.hosts = make(map[string]*destinationEntry)
+	}
+
+	capacity := d.Capacity
+	if capacity <= 0 {
+		capacity = DefaultDestinationStatsCapacity
+	}
+
+	if len(d.heap) < capacity {
+		e := &destinationEntry{DestinationStat: DestinationStat{Host: host, Conns: 1, Bytes: bytes}}
+		d.hosts[host] = e
+		heap.Push(&d.heap, e)
+		return
+	}
+
+	// replace the destination with the least bytes
+	e := d.heap[0]
+	delete(d.hosts, e.Host)
+	e.DestinationStat = DestinationStat{Host: host, Conns: 1, Bytes: e.Bytes + bytes, Error: e.Bytes}
+	d.hosts[host] = e
+	heap.Fix(&d.heap, 0)
+}
+
+// TopDestinations returns up to n destinations with the most Bytes, most
+// first. If n is negative, all tracked destinations are returned.
+func (d *DestinationStats) TopDestinations(n int) []DestinationStat {
+	d.mu.Lock()
+	stats := make([]DestinationStat, len(d.heap))
+	for i, e := range d.heap {
+		stats[i] = e.DestinationStat
+	}
+	d.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Bytes != stats[j].Bytes {
+			return stats[i].Bytes > stats[j].Bytes
+		}
+		return stats[i].Host < stats[j].Host
+	})
+
+	if n >= 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// destinationHeap implements heap.Interface, ordered by Bytes.
+type destinationHeap []*destinationEntry
+
+func (h destinationHeap) Len() int           { return len(h) }
+func (h destinationHeap) Less(i, j int) bool { return h[i].Bytes < h[j].Bytes }
+
+func (h destinationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *destinationHeap) Push(x interface{}) {
+	e := x.(*destinationEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *destinationHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"net"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// EventKind identifies what an Event reports.
+type EventKind int
+
+// Kinds of Event, in the order they occur for a connection.
+const (
+	EventAccepted  EventKind = iota // A client connected.
+	EventHandshake                  // Method negotiation and authentication are done.
+	EventRequest                    // A request is read, Command and Destination are set.
+	EventDial                       // The destination of a CONNECT request is dialed.
+	EventClosed                     // The connection is closed, Err is why if not nil.
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventAccepted:
+		return "accepted"
+	case EventHandshake:
+		return "handshake"
+	case EventRequest:
+		return "request"
+	case EventDial:
+		return "dial"
+	case EventClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something happened to a client connection. Fields are set
+// as soon as they are known, and carried by all later events of the same
+// connection.
+type Event struct {
+	Kind   EventKind
+	Client net.Addr // remote address of the client
+
+	// Username of the client, if authenticated with UserPassAuthenticator.
+	Username string
+
+	Command     byte           // CMD of the request, e.g. 0x01 for CONNECT
+	Destination *protocol.Addr // DST.ADDR and DST.PORT of the request
+
+	BytesUp   int64 // bytes relayed from client to destination
+	BytesDown int64 // bytes relayed from destination to client
+
+	// Err is the failure of the step reported, if any.
+	Err error
+
+	// Reason is why the connection is closed, set for EventClosed only.
+	Reason CloseReason
+}
+
+// EventLogger receives Events of client connections, e.g. to log them in a
+// structured format. LogEvent is called synchronously by goroutines handling
+// connections, so it must be safe for concurrent use, and should return
+// quickly.
+type EventLogger interface {
+	LogEvent(e *Event)
+}
+
+// event reports an Event of kind to s.events, if set, with whatever is known
+// about the connection so far.
+func (s *socks) event(kind EventKind, err error) {
+	if s.events == nil {
+		return
+	}
+
+	e := &Event{
+		Kind:        kind,
+		Client:      s.client.RemoteAddr(),
+		Username:    s.username,
+		Command:     s.cmd,
+		Destination: s.dst,
+		BytesUp:     s.bytesUp,
+		BytesDown:   s.bytesDown,
+		Err:         err,
+	}
+	if kind == EventClosed {
+		e.Reason = s.reason
+	}
+	s.events.LogEvent(e)
+}
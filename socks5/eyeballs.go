@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/tabjy/groundhog/common"
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// fallbackDelay is how long dialing addresses of the preferred address family
+// goes on alone, before addresses of the other family are tried in parallel,
+// as of RFC6555 section 5.5.
+const fallbackDelay = 300 * time.Millisecond
+
+// resolveAll is like resolve, but returns all addresses found for addr if
+// Happy Eyeballs is enabled. Domain names are then resolved with s.resolver
+// if it's a common.MultiResolver, or net.DefaultResolver if s.resolver is nil.
+func (s *socks) resolveAll(ctx context.Context, addr *protocol.Addr) ([]*protocol.Addr, error) {
+	if !s.happyEyeballs || s.remoteDNS || addr.IP != nil {
+		resolved, err := s.resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*protocol.Addr{resolved}, nil
+	}
+
+	var resolver common.MultiResolver
+	switch r := s.resolver.(type) {
+	case nil:
+		resolver = &common.NetResolver{}
+	case common.MultiResolver:
+		resolver = r
+	default:
+		resolved, err := s.resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*protocol.Addr{resolved}, nil
+	}
+
+	ips, err := resolver.ResolveAll(ctx, addr.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]*protocol.Addr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &protocol.Addr{IP: ip, Port: addr.Port}
+	}
+	return addrs, nil
+}
+
+// dialParallel dials addrs as of RFC6555. Addresses of the same family as the
+// first one are dialed one by one, and so are the rest, starting fallbackDelay
+// later, or as soon as the first family has failed. The first connection
+// established is returned, and the other attempt is canceled.
+func (s *socks) dialParallel(ctx context.Context, addrs []*protocol.Addr) (net.Conn, error) {
+	var primaries, fallbacks []*protocol.Addr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (addrs[0].IP.To4() != nil) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	if len(fallbacks) == 0 {
+		return s.dialSerial(ctx, primaries)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+
+	race := func(addrs []*protocol.Addr, primary bool) {
+		conn, err := s.dialSerial(ctx, addrs)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			// lost the race
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var firstErr error
+	pending, fallbackStarted := 1, false
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+
+			if !fallbackStarted {
+				// no point waiting for the timer
+				fallbackStarted = true
+				pending++
+				go race(fallbacks, false)
+			}
+
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial dials addrs one by one, returning the first connection
+// established, or the error of the first attempt if all of them failed.
+func (s *socks) dialSerial(ctx context.Context, addrs []*protocol.Addr) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := s.dialer.DialContext(ctx, "tcp", addr.String())
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+var errRefused = errors.New("connection refused")
+
+// eyeballsDialer connects to addresses in reachable, refuses ones in refused
+// immediately, and blackholes the rest until ctx is done.
+type eyeballsDialer struct {
+	reachable map[string]bool
+	refused   map[string]bool
+
+	mu       sync.Mutex
+	canceled []string // blackholed addresses whose dial was canceled
+}
+
+func (d *eyeballsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *eyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch {
+	case d.reachable[address]:
+		conn, _ := net.Pipe()
+		return conn, nil
+	case d.refused[address]:
+		return nil, errRefused
+	}
+
+	<-ctx.Done()
+	d.mu.Lock()
+	d.canceled = append(d.canceled, address)
+	d.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+func TestDialParallel(t *testing.T) {
+	v6 := &protocol.Addr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	v4 := &protocol.Addr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 80}
+
+	for _, tt := range []struct {
+		name      string
+		reachable []*protocol.Addr
+		refused   []*protocol.Addr
+		min, max  time.Duration // of dialParallel
+		ok        bool
+	}{
+		// IPv4 only tried once fallbackDelay passes without IPv6 connecting
+		{"blackholed primary", []*protocol.Addr{v4}, nil, fallbackDelay, fallbackDelay + 200*time.Millisecond, true},
+		// IPv4 tried as soon as IPv6 fails, not waiting for fallbackDelay
+		{"refused primary", []*protocol.Addr{v4}, []*protocol.Addr{v6}, 0, fallbackDelay / 2, true},
+		{"reachable primary", []*protocol.Addr{v6, v4}, nil, 0, fallbackDelay / 2, true},
+		{"all refused", nil, []*protocol.Addr{v6, v4}, 0, fallbackDelay / 2, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &eyeballsDialer{reachable: map[string]bool{}, refused: map[string]bool{}}
+			for _, addr := range tt.reachable {
+				d.reachable[addr.String()] = true
+			}
+			for _, addr := range tt.refused {
+				d.refused[addr.String()] = true
+			}
+			s := &socks{handler: &handler{dialer: d}}
+
+			start := time.Now()
+			conn, err := s.dialParallel(context.Background(), []*protocol.Addr{v6, v4})
+			elapsed := time.Since(start)
+
+			if tt.ok != (err == nil) {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if err == nil {
+				conn.Close()
+			} else if err != errRefused {
+				t.Fatalf("error %v, want %v of the primary address", err, errRefused)
+			}
+
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Fatalf("took %v, want %v to %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestDialParallelCancelsLoser(t *testing.T) {
+	v6 := &protocol.Addr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	v4 := &protocol.Addr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 80}
+
+	d := &eyeballsDialer{reachable: map[string]bool{v4.String(): true}}
+	s := &socks{handler: &handler{dialer: d}}
+
+	conn, err := s.dialParallel(context.Background(), []*protocol.Addr{v6, v4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// canceled as dialParallel returns, recorded shortly after
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		canceled := len(d.canceled)
+		d.mu.Unlock()
+
+		if canceled == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dialing the blackholed address not canceled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
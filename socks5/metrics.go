@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"net"
+
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// Directions of relayed bytes, as passed to Metrics.ObserveBytes.
+const (
+	DirectionUp   = "up"   // from client to destination
+	DirectionDown = "down" // from destination to client
+)
+
+// Metrics receives counters and gauges of a SOCKS5 server. Methods are called
+// synchronously by goroutines handling connections, so they must be safe for
+// concurrent use, and should return quickly.
+//
+// Metrics is easily adapted to Prometheus, e.g.
+//
+//	type promMetrics struct {
+//		conns  prometheus.Gauge
+//		bytes  *prometheus.CounterVec // labeled by direction
+//		errors *prometheus.CounterVec // labeled by kind
+//	}
+//
+//	func (m *promMetrics) IncConnections() { m.conns.Inc() }
+//	func (m *promMetrics) DecConnections() { m.conns.Dec() }
+//	func (m *promMetrics) ObserveBytes(direction string, n int) {
+//		m.bytes.WithLabelValues(direction).Add(float64(n))
+//	}
+//	func (m *promMetrics) IncErrors(kind string) {
+//		m.errors.WithLabelValues(kind).Inc()
+//	}
+type Metrics interface {
+	// IncConnections and DecConnections are called when handling of a client
+	// connection starts and ends respectively.
+	IncConnections()
+	DecConnections()
+
+	// ObserveBytes is called with the number of bytes relayed in direction,
+	// DirectionUp or DirectionDown, every time some are read.
+	ObserveBytes(direction string, n int)
+
+	// IncErrors is called when a client connection fails, with kind of the
+	// failure, one of "handshake", "request", "command", "resolve",
+	// "ruleset", "ratelimit", "dial", "bind", and "udp".
+	IncErrors(kind string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncConnections()                      {}
+func (nopMetrics) DecConnections()                      {}
+func (nopMetrics) ObserveBytes(direction string, n int) {}
+func (nopMetrics) IncErrors(kind string)                {}
+
+// meteredConn reports bytes read from it to metrics, as relayed in direction.
+type meteredConn struct {
+	net.Conn
+	metrics   Metrics
+	direction string
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.ObserveBytes(c.direction, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	return util.CloseWrite(c.Conn)
+}
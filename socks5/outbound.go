@@ -0,0 +1,50 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// sourceDialer dials from a source IP address, setting LocalAddr of
+// net.Dialer as of the network dialed.
+type sourceDialer struct {
+	ip        net.IP
+	keepAlive time.Duration
+}
+
+func (d *sourceDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: d.keepAlive}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		dialer.LocalAddr = &net.TCPAddr{IP: d.ip}
+	case "udp", "udp4", "udp6":
+		dialer.LocalAddr = &net.UDPAddr{IP: d.ip}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// localIP parses s as an IP address assigned to an interface of this host.
+func localIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a local address", ip)
+}
@@ -0,0 +1,35 @@
+package socks5
+
+import (
+	"net"
+)
+
+// metadataIPs are addresses of cloud instance metadata services not covered
+// by the ranges isPrivateIP checks otherwise, e.g. 169.254.169.254, which is
+// link-local, or fd00:ec2::254, which is unique local.
+var metadataIPs = []net.IP{
+	net.ParseIP("100.100.100.200"), // Alibaba Cloud
+}
+
+// isPrivateIP tells if ip is an address a public proxy must not be used to
+// reach, i.e. unspecified, loopback, link-local, private (RFC1918), unique
+// local (RFC4193), or of a cloud metadata service. IPv4-mapped IPv6 addresses
+// are checked as IPv4.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsPrivate() {
+		return true
+	}
+
+	// 0.0.0.0/8 reaches the host itself on Linux, much like 0.0.0.0
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 0 {
+		return true
+	}
+
+	for _, metadata := range metadataIPs {
+		if ip.Equal(metadata) {
+			return true
+		}
+	}
+	return false
+}
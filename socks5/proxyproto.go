@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// proxyV2Sig is the signature starting a PROXY protocol v2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest PROXY protocol v1 header, including CRLF.
+const maxProxyV1Header = 107
+
+// readProxyHeader reads a PROXY protocol header, either v1 or v2, from r. It
+// returns the source address carried, or nil if there is none, e.g. for
+// health checks of the load balancer itself.
+//
+// A v1 header is a line of text, e.g.
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n
+//
+// A v2 header is binary, with addresses following a 16-byte preamble.
+//
+//	+-----------+---------+--------+-----+-----------+
+//	| SIGNATURE | VER/CMD | FAMILY | LEN | ADDRESSES |
+//	+-----------+---------+--------+-----+-----------+
+//	|    12     |    1    |   1    |  2  |    LEN    |
+//	+-----------+---------+--------+-----+-----------+
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2Header(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxProxyV1Header {
+		return nil, errors.New("PROXY protocol v1 header too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header not terminated with CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if ver := header[12] >> 4; ver != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %#x", ver)
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	switch cmd := header[12] & 0x0F; cmd {
+	case 0x00: // LOCAL
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command: %#x", cmd)
+	}
+
+	// only the address family matters, whether it's TCP or UDP
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(addrs) < 12 {
+			return nil, errors.New("PROXY protocol v2 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(addrs) < 36 {
+			return nil, errors.New("PROXY protocol v2 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxiedConn is a connection from a load balancer, reporting the client
+// address from its PROXY protocol header as RemoteAddr.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	return util.CloseWrite(c.Conn)
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"math"
+	"net"
+
+	"github.com/tabjy/groundhog/common/util"
+	"golang.org/x/time/rate"
+)
+
+// maxRequestLimiters is the number of client IP addresses whose request rates
+// are tracked at once. Beyond that, the least recently seen are forgotten.
+const maxRequestLimiters = 65536
+
+// newRequestLimiter returns a limiter of requests per client IP as of
+// Config.RequestsPerSecPerIP and Config.RequestBurstPerIP, or nil if perSec
+// is 0.
+func newRequestLimiter(perSec float64, burst int) *util.KeyedLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = int(math.Ceil(perSec))
+	}
+	return util.NewKeyedLimiter(rate.Limit(perSec), burst, maxRequestLimiters)
+}
+
+// allowRequest checks the request rate of the client IP address.
+func (s *socks) allowRequest() bool {
+	if s.requestLimiter == nil {
+		return true
+	}
+
+	addr, ok := s.client.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return s.requestLimiter.Allow(addr.IP.String())
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// Request is a SOCKS5 request as of RFC1928 section 4.
+//
+//	+----+-----+-------+------+----------+----------+
+//	|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+//	+----+-----+-------+------+----------+----------+
+//	| 1  |  1  | X'00' |  1   | Variable |    2     |
+//	+----+-----+-------+------+----------+----------+
+type Request struct {
+	Version  byte   // VER, always 0x05
+	Command  byte   // CMD, e.g. 0x01 for CONNECT
+	AddrType byte   // ATYP, one of protocol.AtypIPv4, AtypDomain, and AtypIPv6
+	DestAddr string // DST.ADDR, an IP address or a domain name
+	DestPort uint16 // DST.PORT
+}
+
+// newRequest returns a Request of cmd to dst.
+func newRequest(cmd byte, dst *protocol.Addr) *Request {
+	req := &Request{
+		Version:  socksVer,
+		Command:  cmd,
+		DestPort: dst.Port,
+	}
+
+	switch {
+	case dst.IP.To4() != nil:
+		req.AddrType = protocol.AtypIPv4
+		req.DestAddr = dst.IP.String()
+	case dst.IP != nil:
+		req.AddrType = protocol.AtypIPv6
+		req.DestAddr = dst.IP.String()
+	default:
+		req.AddrType = protocol.AtypDomain
+		req.DestAddr = dst.Domain
+	}
+	return req
+}
+
+// readRequest reads a Request from r. VER and RSV are validated, and domain
+// names must be 1 to 255 bytes long, as their length is sent in one byte.
+func readRequest(r io.Reader) (*Request, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// supports SOCKS5 only
+	if header[0] != socksVer {
+		return nil, fmt.Errorf("unsupported SOCKS version: %#x", header[0])
+	}
+
+	// according to RFC1928, RSV byte must be 0x00
+	if header[2] != 0x00 {
+		return nil, fmt.Errorf("illegal SOCKS reserved field: %#x (must be 0x00)", header[2])
+	}
+
+	// ATYP is read again along with DST.ADDR
+	addr, err := protocol.NewAddrFromReader(io.MultiReader(bytes.NewReader(header[3:]), r))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Version:  header[0],
+		Command:  header[1],
+		AddrType: header[3],
+		DestAddr: addr.Domain,
+		DestPort: addr.Port,
+	}
+	if addr.IP != nil {
+		req.DestAddr = addr.IP.String()
+	}
+	return req, nil
+}
+
+// Dst returns the destination of req.
+func (req *Request) Dst() *protocol.Addr {
+	if req.AddrType == protocol.AtypDomain {
+		return &protocol.Addr{Domain: req.DestAddr, Port: req.DestPort}
+	}
+
+	ip := net.ParseIP(req.DestAddr)
+	if ip4 := ip.To4(); ip4 != nil && req.AddrType == protocol.AtypIPv4 {
+		ip = ip4
+	}
+	return &protocol.Addr{IP: ip, Port: req.DestPort}
+}
+
+// Marshal encodes req as sent by clients.
+func (req *Request) Marshal() ([]byte, error) {
+	addrBytes, err := req.Dst().Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{req.Version, req.Command, 0x00}, addrBytes...), nil
+}
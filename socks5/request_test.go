@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+func TestReadRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  []byte
+		want *Request // nil if an error is expected
+	}{
+		{
+			"IPv4", []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+			&Request{socksVer, cmdConnect, protocol.AtypIPv4, "127.0.0.1", 80},
+		},
+		{
+			"IPv6", append(append([]byte{5, 1, 0, 4}, make([]byte, 15)...), 1, 0, 80),
+			&Request{socksVer, cmdConnect, protocol.AtypIPv6, "::1", 80},
+		},
+		{
+			"domain", []byte("\x05\x01\x00\x03\x0bexample.com\x00\x50"),
+			&Request{socksVer, cmdConnect, protocol.AtypDomain, "example.com", 80},
+		},
+		{"SOCKS4 VER", []byte{4, 1, 0, 1, 127, 0, 0, 1, 0, 80}, nil},
+		{"RSV", []byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, nil},
+		{"unknown ATYP", []byte{5, 1, 0, 2, 127, 0, 0, 1, 0, 80}, nil},
+		{"empty domain", []byte{5, 1, 0, 3, 0, 0, 80}, nil},
+		{"truncated header", []byte{5, 1}, nil},
+		{"truncated IPv4", []byte{5, 1, 0, 1, 127, 0}, nil},
+		{"truncated IPv6", []byte{5, 1, 0, 4, 0, 0, 0, 0}, nil},
+		{"truncated domain", []byte("\x05\x01\x00\x03\x0bexample"), nil},
+		{"truncated port", []byte{5, 1, 0, 1, 127, 0, 0, 1, 0}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readRequest(bytes.NewReader(tt.req))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("read %+v, want an error", req)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *req != *tt.want {
+				t.Fatalf("read %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRequestTruncatedEOF(t *testing.T) {
+	// a client going away mid-request is told apart from a malformed one
+	_, err := readRequest(bytes.NewReader([]byte{5, 1, 0, 1, 127}))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestRequestDomainTooLong(t *testing.T) {
+	req := newRequest(cmdConnect, &protocol.Addr{Domain: strings.Repeat("a", protocol.MaxDomainLen+1), Port: 80})
+	if _, err := req.Marshal(); !errors.Is(err, protocol.ErrDomainTooLong) {
+		t.Fatalf("error %v, want %v", err, protocol.ErrDomainTooLong)
+	}
+
+	if _, err := protocol.NewAddrFromString(strings.Repeat("a", protocol.MaxDomainLen+1) + ":80"); !errors.Is(err, protocol.ErrDomainTooLong) {
+		t.Fatalf("error %v, want %v", err, protocol.ErrDomainTooLong)
+	}
+}
+
+func FuzzReadRequest(f *testing.F) {
+	for _, seed := range [][]byte{
+		{5, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+		append(append([]byte{5, 1, 0, 4}, make([]byte, 15)...), 1, 0, 80),
+		[]byte("\x05\x01\x00\x03\x0bexample.com\x00\x50"),
+		append(append([]byte{5, 1, 0, 3, 255}, strings.Repeat("a", 255)...), 0, 80),
+		{5, 1},
+		{5, 1, 0, 1, 127, 0},
+		[]byte("\x05\x01\x00\x03\x0bexample"),
+		{5, 1, 0, 3, 0, 0, 80},
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := readRequest(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		if req.AddrType == protocol.AtypDomain && (len(req.DestAddr) == 0 || len(req.DestAddr) > protocol.MaxDomainLen) {
+			t.Fatalf("read %d-byte domain", len(req.DestAddr))
+		}
+
+		// whatever is read is sent again as the same destination
+		out, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := readRequest(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.DestAddr != req.DestAddr || again.DestPort != req.DestPort {
+			t.Fatalf("read %+v, then %+v", req, again)
+		}
+
+		// and a domain one byte longer than the maximum is never sent
+		if req.AddrType == protocol.AtypDomain {
+			req.DestAddr += strings.Repeat("a", protocol.MaxDomainLen+1-len(req.DestAddr))
+			if _, err := req.Marshal(); !errors.Is(err, protocol.ErrDomainTooLong) {
+				t.Fatalf("error %v, want %v", err, protocol.ErrDomainTooLong)
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+const socks4Ver byte = 0x04
+
+// Reply codes of SOCKS4.
+const (
+	socks4Granted  byte = 0x5A
+	socks4Rejected byte = 0x5B
+)
+
+// maxSOCKS4Field is the longest USERID or hostname accepted in a SOCKS4
+// request, not counting the terminating NUL.
+const maxSOCKS4Field = 255
+
+// serveSOCKS4 serves a SOCKS4 or SOCKS4a request. Only CONNECT is supported,
+// and only if NO AUTHENTICATION REQUIRED is acceptable for SOCKS5 clients, as
+// SOCKS4 has no authentication. USERID is ignored.
+//
+//	+----+----+----------+----------+----------+------+
+//	| VN | CD | DST.PORT | DST.IP   |  USERID  | NULL |
+//	+----+----+----------+----------+----------+------+
+//	| 1  | 1  |    2     |    4     | Variable |  1   |
+//	+----+----+----------+----------+----------+------+
+//
+// For SOCKS4a, DST.IP is 0.0.0.x with x non-zero, and a NUL-terminated
+// hostname follows.
+func (s *socks) serveSOCKS4(ctx context.Context) error {
+	if err := s.readSOCKS4Request(); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 request: %v", err)
+	}
+	s.client.SetDeadline(time.Time{})
+	s.event(EventRequest, nil)
+
+	s.logger.Tracef("SOCKS4 request %#x from %s to %s", s.cmd, s.client.RemoteAddr(), s.dst.String())
+
+	if !s.acceptsNoAuth() {
+		s.reply(protocol.RepToErr(protocol.RepNotAllowByRuleset), s.local)
+		return errors.New("SOCKS4 request rejected, authentication is required")
+	}
+
+	if s.cmd != cmdConnect || !s.allowedCommands.allows(s.cmd) {
+		s.metrics.IncErrors("command")
+		s.reply(protocol.RepToErr(protocol.RepCommandNotSupported), s.local)
+		return fmt.Errorf("unsupported SOCKS4 command: %#x", s.cmd)
+	}
+
+	return s.withHooks(ctx, s.handleConnect)
+}
+
+func (s *socks) readSOCKS4Request() error {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(s.req, buf); err != nil {
+		return err
+	}
+	s.ver = buf[0]
+	s.cmd = buf[1]
+
+	dst := &protocol.Addr{
+		IP:   net.IP(buf[4:8]),
+		Port: uint16(buf[2])<<8 | uint16(buf[3]),
+	}
+
+	if _, err := s.readSOCKS4Field(); err != nil { // USERID
+		return err
+	}
+
+	if bytes.Equal(buf[4:7], []byte{0, 0, 0}) && buf[7] != 0 {
+		host, err := s.readSOCKS4Field()
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			return errors.New("empty SOCKS4a hostname")
+		}
+		dst = &protocol.Addr{Domain: host, Port: dst.Port}
+	}
+
+	s.dst = dst
+	return nil
+}
+
+// readSOCKS4Field reads a NUL-terminated string.
+func (s *socks) readSOCKS4Field() (string, error) {
+	field, err := s.req.ReadSlice(0x00)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	if len(field)-1 > maxSOCKS4Field {
+		return "", errors.New("SOCKS4 field too long")
+	}
+	return string(field[:len(field)-1]), nil
+}
+
+// acceptsNoAuth checks if NO AUTHENTICATION REQUIRED is acceptable.
+func (s *socks) acceptsNoAuth() bool {
+	for _, auth := range s.authenticators {
+		if auth.Method() == methodNoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// replySOCKS4 is reply for SOCKS4 clients. Only IPv4 addresses are carried
+// in replies, anything else is replied as 0.0.0.0:0.
+func (s *socks) replySOCKS4(err error, addr *protocol.Addr) error {
+	buf := make([]byte, 8)
+	buf[1] = socks4Granted
+	if err != nil {
+		buf[1] = socks4Rejected
+	}
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf[2], buf[3] = byte(addr.Port>>8), byte(addr.Port)
+		copy(buf[4:], ip4)
+	}
+
+	_, err = s.res.Write(buf)
+	return err
+}
@@ -3,95 +3,684 @@ package socks5
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/tabjy/groundhog/common"
+	"github.com/tabjy/groundhog/common/crypto"
 	"github.com/tabjy/groundhog/common/protocol"
 	"github.com/tabjy/groundhog/common/tcp"
 	"github.com/tabjy/groundhog/common/util"
-	"github.com/tabjy/groundhog/common"
 	"github.com/tabjy/yagl"
+	"golang.org/x/time/rate"
+)
+
+const socksVer byte = 0x05
+
+// Authentication methods as of RFC1928 section 3.
+const (
+	methodNoAuth       byte = 0x00
+	methodGSSAPI       byte = 0x01
+	methodUserPass     byte = 0x02
+	methodNoAcceptable byte = 0xFF
 )
 
+// DefaultHandshakeTimeout is how long a client may take to negotiate a
+// method, authenticate, and send its request, if Config.HandshakeTimeout is 0.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultRelayBufferSize is the size of buffers relayed data is copied with,
+// if Config.RelayBufferSize is 0.
+const DefaultRelayBufferSize = util.DefaultBufferSize
+
+// DefaultDialTimeout is how long dialing a destination may take if
+// Config.DialTimeout is 0.
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultKeepAlivePeriod is the TCP keep-alive period if
+// Config.KeepAlivePeriod is 0.
+const DefaultKeepAlivePeriod = 30 * time.Second
+
+// Commands as of RFC1928 section 4.
+const (
+	cmdConnect      byte = 0x01
+	cmdBind         byte = 0x02
+	cmdUDPAssociate byte = 0x03
+)
+
+// ErrInvalidListenHost is returned by Config.Validate if Host is neither an IP
+// address nor a resolvable hostname.
+var ErrInvalidListenHost = errors.New("socks5: invalid listen host")
+
+// ErrInvalidListenPort is returned by Config.Validate if Port is not in range
+// 1 to 65535.
+var ErrInvalidListenPort = errors.New("socks5: invalid listen port")
+
+// ErrNoAuthenticator is returned by Config.Validate if neither Authenticators
+// nor Credentials is set, and AllowNoAuth is not set either.
+var ErrNoAuthenticator = errors.New("socks5: no authenticator configured, " +
+	"set Credentials or Authenticators, or set AllowNoAuth if the server is " +
+	"meant to be an open proxy, usable by anyone able to reach it")
+
 // Config defines optional configurations for a SOCKS5 server. The zero value
-// for Config is a valid configuration.
+// for Config is a valid configuration, except for Port, which must be set,
+// and authentication, which must be configured or explicitly opted out of
+// with AllowNoAuth.
 type Config struct {
-	Host string // IP address or hostname to listen on. Leave empty for an unspecified address.
-	Port uint16 // Port to listen on. A port number is automatically chosen if left empty or 0.
+	Host string // IP address or hostname to listen on, e.g. "::1" or "[::1]" for IPv6. Leave empty for an unspecified address.
+	Port uint16 // Port to listen on, 1 to 65535.
+
+	// Network is either "tcp" or "unix". If "unix", Host is the path of a
+	// Unix domain socket to listen on, and Port is ignored. BIND and UDP
+	// ASSOCIATE requests are not supported over Unix domain sockets. If
+	// empty, "tcp" would be used.
+	Network string
+
+	// Listeners lists additional addresses to listen on, along with
+	// Host:Port, as "host:port", or paths if Network is "unix".
+	Listeners []string
+
+	// ListenConfig, if set, creates listeners, e.g. with a Control function
+	// setting socket options like SO_REUSEPORT. See tcp.Server.ListenConfig.
+	ListenConfig *net.ListenConfig
+
+	// Dialer dials destinations of CONNECT requests, and of datagrams relayed
+	// for UDP ASSOCIATE requests, with network "tcp" and "udp" respectively.
+	// Set it to route outbound traffic elsewhere, e.g. through a tunnel, or a
+	// net.Dialer with LocalAddr set. If nil, net.Dialer would be used.
+	Dialer common.Dialer
+
+	// OutboundSourceIP, if set, is the local IP address connections to
+	// destinations are made from, for CONNECT and UDP ASSOCIATE requests, and
+	// the address BIND requests listen on, e.g. to pick an exit address of a
+	// multi-homed host. It must be assigned to an interface of the host, and
+	// can't be used along with Dialer. Destinations of the other IP version
+	// are unreachable then.
+	OutboundSourceIP string
+
+	// Resolver resolves domain names of destinations before dialing, so that
+	// Dialer is given IP addresses, and never looks them up again. If nil,
+	// domain names are passed on to Dialer as is, which for net.Dialer means
+	// resolving with net.DefaultResolver, and for a tunneling Dialer (e.g.
+	// client.Client) means resolving on the remote end. Wrap a Resolver in
+	// common.CachingResolver to cache results.
+	Resolver common.Resolver
+
+	// RemoteDNS, if set, always passes domain names on to Dialer as is,
+	// ignoring Resolver and HappyEyeballs, e.g. for a tunneling Dialer to
+	// resolve them on the remote end. IP network rules of ACL then only apply
+	// to IP addresses requested by clients.
+	RemoteDNS bool
+
+	// HappyEyeballs, if set, makes CONNECT requests to domain names resolved
+	// to all of their addresses, which are then dialed as of RFC6555, racing
+	// IPv6 and IPv4. Resolver is used if it's a common.MultiResolver, or
+	// net.DefaultResolver if Resolver is nil. Otherwise, the single address
+	// from Resolver is dialed as usual.
+	HappyEyeballs bool
+
+	// ACL, if set, restricts which destinations clients may connect to.
+	// Denied requests are replied with "connection not allowed by ruleset".
+	ACL *ACL
+
+	// AllowPrivateDestinations, if set, lets clients reach private
+	// destinations, which are denied by default, so that a proxy reachable
+	// from the internet can't be used to reach into the network it runs in,
+	// e.g. cloud metadata services at 169.254.169.254. CONNECT and UDP
+	// ASSOCIATE requests to unspecified, loopback, link-local, private
+	// (RFC1918), and unique local (RFC4193) addresses, and known cloud
+	// metadata addresses, are replied with "connection not allowed by
+	// ruleset", or dropped for UDP. Domain names are checked once resolved,
+	// and the resolved address is dialed, so they can't be rebound to private
+	// addresses in between. Unless AllowPrivateDestinations is set, they're
+	// resolved with net.DefaultResolver if Resolver is nil. With RemoteDNS,
+	// only IP addresses requested by clients are checked.
+	AllowPrivateDestinations bool
+
+	// Crypto, if set, makes an encrypted SOCKS5 server, e.g. a groundhog
+	// remote. It's called for each accepted connection, and the connection is
+	// wrapped with Plaintext of the returned EncryptDecrypter before anything
+	// is read from it. A fresh EncryptDecrypter must be returned every time,
+	// so that no state, e.g. IVs, is shared between connections. UDP
+	// ASSOCIATE requests are not supported, as datagrams would go unencrypted.
+	Crypto func() (crypto.EncryptDecrypter, error)
+
+	// Tunnel, if set, makes a groundhog remote serving groundhog locals (see
+	// package local) instead of SOCKS5 clients. A connection starts with the
+	// destination address only, which is served as a CONNECT request, and
+	// replied with a single REP byte. Tunnel requires Crypto.
+	Tunnel bool
+
+	// Multiplex, if set, makes each connection from groundhog locals carry
+	// multiple streams with yamux, each served as a connection of Tunnel.
+	// Multiplex requires Tunnel. MaxConns applies to connections, not
+	// streams.
+	Multiplex bool
+
+	// HTTPConnect, if set, makes an HTTP CONNECT proxy instead of a SOCKS5
+	// server, for clients speaking HTTP rather than SOCKS5. CONNECT requests
+	// are served as SOCKS5 CONNECT requests, with the same Dialer, ACL,
+	// timeouts, and Metrics, and replied with an HTTP status. If Credentials
+	// or UserPassAuthenticator is set, clients authenticate with Basic
+	// credentials in Proxy-Authorization. To serve both SOCKS5 and HTTP
+	// CONNECT, run two servers with Configs differing in HTTPConnect and
+	// Port. HTTPConnect can't be used along with Tunnel.
+	HTTPConnect bool
+
+	// ProxyProtocol, if set, requires every connection to start with a PROXY
+	// protocol header, v1 or v2, as sent by load balancers such as HAProxy.
+	// The client address carried replaces that of the load balancer, e.g. for
+	// ClientAddrFromContext, OnConnect, Events, and logging. Only set it
+	// behind a trusted load balancer, or clients could spoof their addresses.
+	ProxyProtocol bool
+
+	// EnableSOCKS4, if set, serves SOCKS4 and SOCKS4a clients as well, told
+	// apart by the first byte they send. Only CONNECT is supported for them,
+	// and only if NO AUTHENTICATION REQUIRED is accepted, as SOCKS4 has no
+	// authentication. Replies to them carry IPv4 addresses only.
+	EnableSOCKS4 bool
+
+	// AllowedCommands is the set of commands clients may request, e.g.
+	// CommandConnect|CommandBind. Requests of other commands are replied with
+	// "command not supported" before anything is dialed or bound. If 0,
+	// DefaultAllowedCommands would be used, i.e. only CONNECT, so BIND and
+	// UDP ASSOCIATE have to be enabled explicitly.
+	AllowedCommands Commands
+
+	// Authenticators lists accepted authentication methods, in order of
+	// preference. If nil, UserPassAuthenticator with Credentials would be used
+	// if Credentials is set, otherwise NoAuthAuthenticator if AllowNoAuth is
+	// set.
+	Authenticators []Authenticator
+
+	// Credentials, if set, requires clients to authenticate with
+	// username/password (RFC1929), checked against Credentials. Clients
+	// offering NO AUTHENTICATION REQUIRED only are rejected. Ignored if
+	// Authenticators is set.
+	Credentials CredentialStore
+
+	// AllowNoAuth, if set, allows neither Authenticators nor Credentials to
+	// be set, serving clients without authentication. Without it, Validate
+	// fails with ErrNoAuthenticator, so that an open proxy is never served by
+	// accident. It's not needed with Tunnel, or with NoAuthAuthenticator
+	// listed in Authenticators.
+	AllowNoAuth bool
 
-	Dialer common.Dialer // Dialer implementation. If nil, net.Dialer would be used.
+	// HandshakeTimeout is how long a client may take to negotiate a method,
+	// authenticate, and send its request, after which the connection is
+	// closed, so that slow or stalled clients can't hold connections forever.
+	// It's separate from IdleTimeout, which applies once relaying starts. If
+	// 0, DefaultHandshakeTimeout would be used. If negative, clients may take
+	// forever.
+	HandshakeTimeout time.Duration
+
+	// DialTimeout is how long dialing a destination may take. If 0,
+	// DefaultDialTimeout would be used.
+	DialTimeout time.Duration
+
+	// IdleTimeout closes a relayed connection if no data flows in either
+	// direction for that long. If 0, relayed connections never time out.
+	IdleTimeout time.Duration
+
+	// KeepAlivePeriod is the TCP keep-alive period of client connections, and
+	// of TCP connections to destinations, so that dead peers behind NATs are
+	// detected. If 0, DefaultKeepAlivePeriod would be used. If negative,
+	// keep-alives are disabled.
+	KeepAlivePeriod time.Duration
+
+	// PerConnBytesPerSec limits throughput of each relayed connection, in each
+	// direction. If 0, it's unlimited. It must not be negative.
+	PerConnBytesPerSec int
+
+	// TotalBytesPerSec limits throughput of all relayed connections combined,
+	// in each direction. If 0, it's unlimited. It must not be negative.
+	TotalBytesPerSec int
+
+	// RelayBufferSize is the size of buffers relayed data is copied with. Each
+	// relayed connection holds two of them, one for each direction, for as
+	// long as it's open, so smaller buffers save memory where many mostly
+	// idle connections are open at once, e.g. of interactive sessions, while
+	// larger ones take fewer system calls for bulk transfers. Buffers are
+	// reused across connections. Data spliced between TCP connections takes
+	// no buffer. If 0, DefaultRelayBufferSize would be used.
+	RelayBufferSize int
+
+	// RequestsPerSecPerIP limits how many requests each client IP address
+	// may make per second, with bursts of up to RequestBurstPerIP requests,
+	// or RequestsPerSecPerIP rounded up if 0. Requests over the limit are
+	// replied with "connection not allowed by ruleset", and closed. If 0,
+	// it's unlimited. Unlike MaxConns, it throttles connection churn rather
+	// than connections open at once. Clients connecting over Unix domain
+	// sockets are not limited.
+	RequestsPerSecPerIP float64
+	RequestBurstPerIP   int
+
+	// BindTimeout is how long a BIND request waits for an inbound connection.
+	// If 0, DefaultBindTimeout would be used.
+	BindTimeout time.Duration
+
+	// MaxConns limits the number of client connections handled at once. At
+	// the limit, new connections wait to be accepted, or if RejectWhenFull is
+	// set, are closed immediately. If 0, it's unlimited.
+	MaxConns       int
+	RejectWhenFull bool
+
+	// AcceptFilter, if set, is called with every client connection as soon
+	// as it's accepted, before anything is read from it, and the connection
+	// is closed if it returns false. It's cheaper than ACL for blunt IP bans
+	// by RemoteAddr, which is still that of the load balancer with
+	// ProxyProtocol.
+	AcceptFilter func(conn net.Conn) bool
+
+	// OnConnect, if set, is called with the client address and destination
+	// of each request, before it's served. If it returns an error, the
+	// request is replied with "connection not allowed by ruleset" instead.
+	OnConnect func(ctx context.Context, clientAddr net.Addr, dst string) error
+
+	// OnClose, if set, is called once a request accepted by OnConnect has
+	// been served, with the error it failed with, if any. Why the connection
+	// is closed is reported in Reason of EventClosed to EventLogger.
+	OnClose func(ctx context.Context, clientAddr net.Addr, dst string, err error)
+
+	// EventLogger, if set, receives structured Events at key points of each
+	// client connection, from being accepted to being closed.
+	EventLogger EventLogger
+
+	// Metrics, if set, receives counters and gauges of client connections.
+	Metrics Metrics
+
+	// DestinationStats, if set, aggregates requests and bytes relayed by
+	// destination host, e.g. to find the destinations with the most traffic
+	// with TopDestinations.
+	DestinationStats *DestinationStats
 
 	// Logger specifies an optional logger
-	// If nil, logging goes to os.Stderr via a yagl standard logger.
+	// If nil, nothing is logged.
 	Logger yagl.Logger
 }
 
+// Validate checks that config is usable for listening, returning
+// ErrInvalidListenHost or ErrInvalidListenPort otherwise. A hostname is
+// looked up to check that it resolves. ErrNoAuthenticator is returned if no
+// authentication is configured without AllowNoAuth.
+func (config *Config) Validate() error {
+	if config.Tunnel && config.Crypto == nil {
+		return errors.New("socks5: Tunnel requires Crypto")
+	}
+
+	if config.Multiplex && !config.Tunnel {
+		return errors.New("socks5: Multiplex requires Tunnel")
+	}
+
+	if config.HTTPConnect && config.Tunnel {
+		return errors.New("socks5: HTTPConnect can't be used along with Tunnel")
+	}
+
+	// clients of Tunnel authenticate by Crypto
+	if !config.Tunnel && !config.AllowNoAuth && config.Authenticators == nil && config.Credentials == nil {
+		return ErrNoAuthenticator
+	}
+
+	if config.RelayBufferSize < 0 {
+		return errors.New("socks5: RelayBufferSize must not be negative")
+	}
+
+	if config.PerConnBytesPerSec < 0 || config.TotalBytesPerSec < 0 {
+		return errors.New("socks5: PerConnBytesPerSec and TotalBytesPerSec must not be negative")
+	}
+
+	if config.OutboundSourceIP != "" {
+		if config.Dialer != nil {
+			return errors.New("socks5: OutboundSourceIP can't be used along with Dialer")
+		}
+		if _, err := localIP(config.OutboundSourceIP); err != nil {
+			return fmt.Errorf("socks5: invalid OutboundSourceIP: %v", err)
+		}
+	}
+
+	switch config.Network {
+	case "", "tcp":
+	case "unix":
+		if config.Host == "" {
+			return fmt.Errorf("%w: path of Unix domain socket must be set", ErrInvalidListenHost)
+		}
+		return nil
+	default:
+		return fmt.Errorf("socks5: unsupported network %q", config.Network)
+	}
+
+	if host := listenHost(config.Host); host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidListenHost, config.Host, err)
+		}
+	}
+
+	if config.Port == 0 {
+		return ErrInvalidListenPort
+	}
+
+	for _, addr := range config.Listeners {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidListenHost, err)
+		}
+
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%w: %s", ErrInvalidListenPort, addr)
+		}
+	}
+
+	return nil
+}
+
+// listenHost returns host with brackets around an IPv6 address removed, e.g.
+// "::1" for "[::1]", so that it can be joined with a port.
+func listenHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// nopLogger discards whatever is logged, by servers without Config.Logger.
+var nopLogger = yagl.New(0, yagl.LvlFatal, io.Discard)
+
 // NewServer takes a SOCKS5 Config and return a tcp.Server. The returned server
 // has to be manually started by calling srv.Listen and srv.Server (or just
-// srv.ListenAndServer).
-func NewServer(config *Config) *tcp.Server {
+// srv.ListenAndServer). config is validated with Validate first.
+func NewServer(config *Config) (*tcp.Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	var logger yagl.Logger
 	if config.Logger != nil {
 		logger = config.Logger
 	} else {
-		logger = yagl.StdLogger()
+		logger = nopLogger
+	}
+
+	handshakeTimeout := config.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = DefaultHandshakeTimeout
+	}
+
+	keepAlivePeriod := config.KeepAlivePeriod
+	if keepAlivePeriod == 0 {
+		keepAlivePeriod = DefaultKeepAlivePeriod
+	}
+
+	var outboundIP net.IP
+	if config.OutboundSourceIP != "" {
+		outboundIP, _ = localIP(config.OutboundSourceIP) // validated already
 	}
 
 	var dialer common.Dialer
-	if config.Dialer != nil {
+	switch {
+	case config.Dialer != nil:
 		dialer = config.Dialer
+	case outboundIP != nil:
+		dialer = &sourceDialer{ip: outboundIP, keepAlive: keepAlivePeriod}
+	default:
+		dialer = &net.Dialer{KeepAlive: keepAlivePeriod}
+	}
+
+	host := config.Host
+	if config.Network != "unix" {
+		host = listenHost(host)
+	}
+
+	dialTimeout := config.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+
+	relayBufferSize := config.RelayBufferSize
+	if relayBufferSize == 0 {
+		relayBufferSize = DefaultRelayBufferSize
+	}
+
+	var metrics Metrics
+	if config.Metrics != nil {
+		metrics = config.Metrics
 	} else {
-		dialer = &net.Dialer{}
+		metrics = nopMetrics{}
+	}
+
+	allowedCommands := config.AllowedCommands
+	if allowedCommands == 0 {
+		allowedCommands = DefaultAllowedCommands
+	}
+
+	authenticators := config.Authenticators
+	if authenticators == nil {
+		if config.Credentials != nil {
+			authenticators = []Authenticator{UserPassAuthenticator{config.Credentials}}
+		} else {
+			authenticators = []Authenticator{NoAuthAuthenticator{}}
+		}
 	}
 
 	return &tcp.Server{
-		Host: config.Host,
-		Port: config.Port,
+		Host:    host,
+		Port:    config.Port,
+		Network: config.Network,
+		Addrs:   config.Listeners,
+
+		ListenConfig: config.ListenConfig,
+
 		Handler: &handler{
-			dialer: dialer,
-			logger: logger,
+			dialer:         dialer,
+			resolver:       config.Resolver,
+			happyEyeballs:  config.HappyEyeballs,
+			remoteDNS:      config.RemoteDNS,
+			outboundIP:     outboundIP,
+			acl:            config.ACL,
+			logger:         logger,
+			events:         config.EventLogger,
+			onConnect:      config.OnConnect,
+			onClose:        config.OnClose,
+			metrics:        metrics,
+			authenticators: authenticators,
+			enableSOCKS4:   config.EnableSOCKS4,
+			proxyProtocol:  config.ProxyProtocol,
+			crypto:         config.Crypto,
+			tunnel:         config.Tunnel,
+			multiplex:      config.Multiplex,
+
+			handshakeTimeout: handshakeTimeout,
+			dialTimeout:      dialTimeout,
+			idleTimeout:      config.IdleTimeout,
+			bindTimeout:      config.BindTimeout,
+			keepAlivePeriod:  keepAlivePeriod,
+
+			perConnBytesPerSec: config.PerConnBytesPerSec,
+			totalUp:            util.NewLimiter(config.TotalBytesPerSec),
+			totalDown:          util.NewLimiter(config.TotalBytesPerSec),
+			relayBuffers:       util.NewBufferPool(relayBufferSize),
+
+			requestLimiter: newRequestLimiter(config.RequestsPerSecPerIP, config.RequestBurstPerIP),
+
+			allowedCommands: allowedCommands,
+			blockPrivate:    !config.AllowPrivateDestinations,
+			destinations:    config.DestinationStats,
+			httpConnect:     config.HTTPConnect,
 		},
-		Logger: logger,
-	}
+		MaxConns:       config.MaxConns,
+		RejectWhenFull: config.RejectWhenFull,
+		AcceptFilter:   config.AcceptFilter,
+		Logger:         logger,
+	}, nil
 }
 
+// handler holds settings shared by all connections of a server.
 type handler struct {
-	dialer common.Dialer
-	logger yagl.Logger
+	dialer         common.Dialer
+	resolver       common.Resolver
+	happyEyeballs  bool
+	remoteDNS      bool
+	outboundIP     net.IP // nil if unset
+	acl            *ACL
+	logger         yagl.Logger
+	events         EventLogger
+	onConnect      func(ctx context.Context, clientAddr net.Addr, dst string) error
+	onClose        func(ctx context.Context, clientAddr net.Addr, dst string, err error)
+	metrics        Metrics
+	authenticators []Authenticator
+	enableSOCKS4   bool
+	proxyProtocol  bool
+	crypto         func() (crypto.EncryptDecrypter, error)
+	tunnel         bool
+	multiplex      bool
+
+	handshakeTimeout time.Duration // negative if disabled
+	dialTimeout      time.Duration
+	idleTimeout      time.Duration
+	bindTimeout      time.Duration
+	keepAlivePeriod  time.Duration // negative if disabled
+
+	perConnBytesPerSec int
+	totalUp            *rate.Limiter // shared by all connections from clients
+	totalDown          *rate.Limiter // shared by all connections to targets
+	relayBuffers       *util.BufferPool
+
+	requestLimiter *util.KeyedLimiter // keyed by client IP, nil if unlimited
+
+	allowedCommands Commands
+	blockPrivate    bool
+	destinations    *DestinationStats // nil if not aggregated
+	httpConnect     bool
 }
 
 func (h *handler) ServeTCP(ctx context.Context, conn net.Conn) {
-	s := socks{
-		dialer: h.dialer,
-		logger: h.logger,
+	h.metrics.IncConnections()
+	defer h.metrics.DecConnections()
+
+	h.setKeepAlive(conn)
+
+	if h.proxyProtocol {
+		h.setHandshakeDeadline(conn)
+
+		r := bufio.NewReader(conn)
+		src, err := readProxyHeader(r)
+		if err != nil {
+			h.logger.Errorf("failed to read PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if src == nil {
+			src = conn.RemoteAddr()
+		}
+		conn = &proxiedConn{Conn: conn, r: r, remote: src}
+	}
+
+	if h.crypto != nil {
+		ed, err := h.crypto()
+		if err != nil {
+			h.logger.Errorf("failed to set up encryption for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		plaintext, err := ed.Plaintext(conn)
+		if err != nil {
+			h.logger.Errorf("failed to set up encryption for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer plaintext.Close()
+		conn = plaintext
+
+		if c, ok := plaintext.(*crypto.CipherConn); ok {
+			h.logger.Tracef("encrypted connection from %s, %s with %d-byte key", conn.RemoteAddr(), c.Mode(), c.KeyLen())
+		}
+	}
+
+	if h.multiplex {
+		h.serveSession(ctx, conn)
+		return
 	}
+
+	s := socks{handler: h}
 	s.init(ctx, conn)
 }
 
+// setHandshakeDeadline sets deadline of conn as of h.handshakeTimeout.
+func (h *handler) setHandshakeDeadline(conn net.Conn) {
+	if h.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(h.handshakeTimeout))
+	}
+}
+
+// setKeepAlive sets TCP keep-alive of conn as of h.keepAlivePeriod, if conn
+// is a *net.TCPConn.
+func (h *handler) setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if h.keepAlivePeriod < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(h.keepAlivePeriod)
+}
+
+type clientAddrKey struct{}
+
+// ClientAddrFromContext returns remote address of the client, from ctx passed
+// to Authenticators, and to Resolver and Dialer on behalf of the client. Such
+// ctx also carries the username of the client, see UsernameFromContext, and
+// is canceled once the server is closed.
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr, ok
+}
+
 type socks struct {
-	dialer common.Dialer
-	logger yagl.Logger
+	*handler
 
 	client net.Conn
 	target net.Conn
 
-	req io.Reader
+	req *bufio.Reader
 	res io.Writer
 
 	dst   *protocol.Addr
 	src   *protocol.Addr
 	local *protocol.Addr
+
+	ver byte // SOCKS version of the client
+
+	// reported in events
+	username  string
+	cmd       byte
+	bytesUp   int64
+	bytesDown int64
+	reason    CloseReason // see closeReason
 }
 
 func (s *socks) init(ctx context.Context, conn net.Conn) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	ctx = context.WithValue(ctx, clientAddrKey{}, conn.RemoteAddr())
+
+	// set before the watchdog below reads s.client
+	s.client = conn
+	s.req = bufio.NewReader(conn)
+	s.res = conn
+	s.local = tcpAddr(conn.LocalAddr())
+	s.src = tcpAddr(conn.RemoteAddr())
 
 	// watchdog to close connections if context cancelled
-	go func() {
+	go func(ctx context.Context) {
 		<-ctx.Done() // this doesn't block forever, Server call cancel after ServeTCP returns
 
 		if s.client != nil {
@@ -101,160 +690,346 @@ func (s *socks) init(ctx context.Context, conn net.Conn) {
 		if s.target != nil {
 			s.target.Close()
 		}
-	}()
+	}(ctx)
 
-	conn.(*net.TCPConn).SetKeepAlive(true)
+	var err error
+	s.event(EventAccepted, nil)
+	defer func() {
+		s.reason = s.closeReason(err)
+		s.event(EventClosed, err)
 
-	s.client = conn
-	s.req = bufio.NewReader(conn)
-	s.res = conn
-	s.local = &protocol.Addr{
-		IP:   conn.LocalAddr().(*net.TCPAddr).IP,
-		Port: uint16(conn.LocalAddr().(*net.TCPAddr).Port),
-	}
-	s.src = &protocol.Addr{
-		IP:   conn.RemoteAddr().(*net.TCPAddr).IP,
-		Port: uint16(conn.RemoteAddr().(*net.TCPAddr).Port),
-	}
+		if s.destinations != nil && s.dst != nil {
+			host := s.dst.Domain
+			if host == "" {
+				host = s.dst.IP.String()
+			}
+			s.destinations.observe(host, s.bytesUp+s.bytesDown)
+		}
+	}()
 
-	if err := s.assertSOCKSVer(); err != nil {
-		s.logger.Errorf("failed to assert SOCKS version: %v", err.Error())
-		return
-	}
+	// lifted once the request is read
+	s.setHandshakeDeadline(conn)
 
-	if err := s.auth(); err != nil {
-		s.logger.Errorf("failed to authenticate SOCKS user: %v", err.Error())
+	if s.tunnel {
+		if err = s.serveTunnel(ctx); err != nil {
+			s.logger.Error(err)
+		}
 		return
 	}
 
-	if err := s.assertSOCKSVer(); err != nil {
-		s.logger.Errorf("failed to assert SOCKS version: %v", err.Error())
+	if s.httpConnect {
+		if err = s.serveHTTP(ctx); err != nil {
+			s.logger.Error(err)
+		}
 		return
 	}
 
-	if err := s.assertCmd(); err != nil {
-		s.logger.Errorf("failed to assert SOCKS command: %v", err.Error())
-		return
+	if s.enableSOCKS4 {
+		if ver, _ := s.req.Peek(1); len(ver) == 1 && ver[0] == socks4Ver {
+			if err = s.serveSOCKS4(ctx); err != nil {
+				s.logger.Error(err)
+			}
+			return
+		}
 	}
+	s.ver = socksVer
 
-	if err := s.assertRsvByte(); err != nil {
-		s.logger.Errorf("failed to assert SOCKS reserved byte: %v", err.Error())
+	authCtx, err := s.handshake(ctx)
+	s.event(EventHandshake, err)
+	if err != nil {
+		s.metrics.IncErrors("handshake")
+		s.logger.Errorf("failed SOCKS handshake: %v", err.Error())
 		return
 	}
+	ctx = authCtx
+	s.username, _ = UsernameFromContext(ctx)
 
-	if err := s.readDstAddr(); err != nil {
-		s.logger.Errorf("failed to assert parse SOCKS request dst: %v", err.Error())
+	s.cmd, err = s.readRequest()
+	if err != nil {
+		s.metrics.IncErrors("request")
+		s.logger.Errorf("failed to read SOCKS request: %v", err.Error())
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	s.event(EventRequest, nil)
 
-	s.logger.Tracef("request from %s to %s", s.client.RemoteAddr(), s.dst.String())
+	s.logger.Tracef("request %#x from %s to %s", s.cmd, s.client.RemoteAddr(), s.dst.String())
 
-	// only CONNECT command is supported for this moment
-	var dialErr error
-	s.target, dialErr = s.dialer.DialContext(ctx, "tcp", s.dst.String())
+	_, overTCP := conn.LocalAddr().(*net.TCPAddr)
+
+	switch {
+	case !s.allowedCommands.allows(s.cmd):
+		s.metrics.IncErrors("command")
+		s.reply(protocol.RepToErr(protocol.RepCommandNotSupported), s.local)
+		err = fmt.Errorf("SOCKS command %#x not allowed", s.cmd)
+	case s.cmd == cmdConnect:
+		err = s.withHooks(ctx, s.handleConnect)
+	case s.cmd == cmdBind && overTCP:
+		err = s.withHooks(ctx, s.handleBind)
+	case s.cmd == cmdUDPAssociate && overTCP && s.crypto == nil:
+		err = s.withHooks(ctx, s.handleUDPAssociate)
+	default:
+		s.metrics.IncErrors("command")
+		s.reply(protocol.RepToErr(protocol.RepCommandNotSupported), s.local)
+		err = fmt.Errorf("unsupported SOCKS command: %#x", s.cmd)
+	}
 
-	if err := s.reply(dialErr, s.local); err != nil {
+	if err != nil {
 		s.logger.Error(err)
-		return
 	}
+}
 
-	if dialErr != nil {
-		s.logger.Errorf("failed to dial target server: %v", dialErr.Error())
-		return
+// withHooks calls handle to serve the request, in between s.onConnect and
+// s.onClose if set. If the client is over its request rate, or s.onConnect
+// fails, the request is replied with "connection not allowed by ruleset"
+// instead.
+func (s *socks) withHooks(ctx context.Context, handle func(ctx context.Context) error) error {
+	if !s.allowRequest() {
+		s.metrics.IncErrors("ratelimit")
+		s.reply(protocol.RepToErr(protocol.RepNotAllowByRuleset), s.local)
+		return fmt.Errorf("request from %s to %s rejected, too many requests", s.client.RemoteAddr(), s.dst)
 	}
-	defer s.target.Close()
 
-	s.logger.Tracef("target connected, %s", s.target.RemoteAddr())
+	if s.onConnect != nil {
+		if err := s.onConnect(ctx, s.client.RemoteAddr(), s.dst.String()); err != nil {
+			s.metrics.IncErrors("ruleset")
+			s.reason = CloseACL
+			s.reply(protocol.RepToErr(protocol.RepNotAllowByRuleset), s.local)
+			return fmt.Errorf("request to %s rejected by OnConnect: %v", s.dst, err)
+		}
+	}
 
-	/* it turns out this logic is unnecessary, no error with or without this, but why...
-	// XXX: stop using bufio from here, but some bytes are already buffered
-	bufReq := s.req.(*bufio.Reader)  // s.req must be *bufio.Reader
-	bufLen := bufReq.Buffered()      // get number of bytes buffered
-	buffered := make([]byte, bufLen) // make room for buffered bytes
+	err := handle(ctx)
 
-	// load buffered bytes without advancing the reader
-	buffered, bufErr := bufReq.Peek(bufLen)
-	if bufErr != nil {
-		s.logger.Error(bufErr)
-		return
+	if s.onClose != nil {
+		s.onClose(ctx, s.client.RemoteAddr(), s.dst.String(), err)
 	}
+	return err
+}
 
-	// send buffered bytes to target server
-	if _, err := io.Copy(s.target, bytes.NewBuffer(buffered)); err != nil {
-		s.logger.Error(err)
-		return
+// tcpAddr returns addr as a protocol.Addr, or 0.0.0.0:0 if addr is not a TCP
+// address, e.g. of a Unix domain socket. IPv4 addresses are always 4 bytes
+// long, so they are marshaled as such.
+func tcpAddr(addr net.Addr) *protocol.Addr {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &protocol.Addr{IP: ip, Port: uint16(addr.Port)}
 	}
-	*/
+	return &protocol.Addr{IP: net.IPv4zero.To4()}
+}
 
-	if _, _, err := util.Proxy(s.target, s.client); err != nil {
-		s.logger.Error(err)
-		return
+// readRequest reads a SOCKS request as of RFC1928 section 4, i.e. VER, CMD,
+// RSV, ATYP, DST.ADDR, and DST.PORT. It returns CMD and sets s.dst.
+func (s *socks) readRequest() (byte, error) {
+	req, err := readRequest(s.req)
+	if err != nil {
+		return 0, err
 	}
 
-	return
+	s.dst = req.Dst()
+	return req.Command, nil
 }
 
-func (s *socks) assertSOCKSVer() error {
-	ver := []byte{0}
-	if _, err := s.req.Read(ver); err != nil {
+// handleConnect serves a CONNECT request. It dials s.dst, replies with the
+// result, and relays data between client and target until either side
+// closes.
+func (s *socks) handleConnect(ctx context.Context) error {
+	resolved, err := s.resolveAll(ctx, s.dst)
+	if err != nil {
+		s.metrics.IncErrors("resolve")
+		s.reply(err, s.local)
+		return fmt.Errorf("failed to resolve %s: %v", s.dst.Domain, err)
+	}
+
+	var addrs []*protocol.Addr
+	for _, addr := range resolved {
+		if s.allowed(s.dst, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		s.metrics.IncErrors("ruleset")
+		s.reason = CloseACL
+		s.reply(protocol.RepToErr(protocol.RepNotAllowByRuleset), s.local)
+		return fmt.Errorf("connection to %s not allowed by ruleset", s.dst)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	defer cancel()
+
+	var dialErr error
+	if len(addrs) == 1 {
+		s.target, dialErr = s.dialer.DialContext(dialCtx, "tcp", addrs[0].String())
+	} else {
+		s.target, dialErr = s.dialParallel(dialCtx, addrs)
+	}
+
+	repErr := dialErr
+	if dialErr != nil && ctx.Err() == nil && (dialCtx.Err() == context.DeadlineExceeded || isTimeout(dialErr)) {
+		// dialErr could be anything, depending on the Dialer
+		repErr = protocol.RepToErr(protocol.RepTTLExpired)
+	}
+
+	s.event(EventDial, dialErr)
+
+	// BND.ADDR and BND.PORT are the address of the outbound connection
+	bnd := s.local
+	if dialErr == nil {
+		bnd = tcpAddr(s.target.LocalAddr())
+	}
+
+	if err := s.reply(repErr, bnd); err != nil {
 		return err
 	}
 
-	// supports SOCKS5 only
-	if ver[0] != byte(0x05) {
-		return fmt.Errorf("unsupported SOCKS version: %#x", ver[0])
+	if dialErr != nil {
+		s.metrics.IncErrors("dial")
+		return fmt.Errorf("failed to dial target server: %v", dialErr)
 	}
+	defer s.target.Close()
+	s.setKeepAlive(s.target)
 
-	return nil
+	s.logger.Tracef("target connected, %s", s.target.RemoteAddr())
+
+	return s.relay(ctx)
 }
 
-func (s *socks) auth() error {
-	methodLen := []byte{0}
-	if _, err := s.req.Read(methodLen); err != nil {
-		return err
+// relay relays data between client and target until either side closes, with
+// configured rate limits and idle timeout applied. s.reason is set to which
+// side closed first, or CloseIdleTimeout.
+//
+// Without rate limits, idle timeout, and Metrics, data is relayed by io.Copy
+// straight between the connections, so that between two TCP connections, the
+// kernel moves it with splice(2) on Linux, never copying it to user space.
+// Encrypted connections can't take this path, as data has to be decrypted and
+// encrypted in user space.
+func (s *socks) relay(ctx context.Context) error {
+	var up, down []*rate.Limiter
+	if l := util.NewLimiter(s.perConnBytesPerSec); l != nil {
+		up = append(up, l)
+		down = append(down, util.NewLimiter(s.perConnBytesPerSec))
+	}
+	if s.totalUp != nil {
+		up = append(up, s.totalUp)
+		down = append(down, s.totalDown)
 	}
 
-	methods := make([]byte, int(methodLen[0]))
-	if _, err := io.ReadAtLeast(s.req, methods, int(methodLen[0])); err != nil {
-		return err
+	var rec eofRecorder
+	var target net.Conn = &eofConn{Conn: s.target, rec: &rec, reason: CloseServerEOF}
+	var client net.Conn = &eofConn{Conn: s.client, rec: &rec, reason: CloseClientEOF}
+	if _, ok := s.metrics.(nopMetrics); !ok {
+		target = &meteredConn{Conn: target, metrics: s.metrics, direction: DirectionDown}
+		client = &meteredConn{Conn: client, metrics: s.metrics, direction: DirectionUp}
 	}
+	target = util.RateLimitedConn(ctx, target, down...)
+	client = util.RateLimitedConn(ctx, client, up...)
+
+	var err error
+	s.bytesUp, s.bytesDown, err = util.ProxyIdleBuffer(target, client, s.idleTimeout, s.relayBuffers)
+
+	switch {
+	case err != nil && s.idleTimeout > 0 && isTimeout(err):
+		s.reason = CloseIdleTimeout
+	case err == nil && rec.seen:
+		s.reason = rec.reason
+	}
+	return err
+}
 
-	// supports NO AUTHENTICATION REQUIRED only
-	for method := range methods {
-		if method == 0x00 { // 0x00 for NO AUTHENTICATION REQUIRED
-			s.res.Write([]byte{0x05, 0x00})
-			return nil
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// allowed checks dst, and resolved if not nil, against s.acl, and unless
+// private destinations are allowed, checks the IP address of resolved, if
+// any, isn't private.
+func (s *socks) allowed(dst, resolved *protocol.Addr) bool {
+	if s.blockPrivate && resolved != nil && resolved.IP != nil && isPrivateIP(resolved.IP) {
+		return false
+	}
+	return s.acl == nil || s.acl.Allowed(dst, resolved)
+}
+
+// resolve returns addr with its domain name resolved by s.resolver. addr is
+// returned as is if it has an IP address already, or if s.remoteDNS is set, or
+// if s.resolver is nil and private destinations are allowed. Otherwise, a nil
+// s.resolver resolves with net.DefaultResolver, so that the address can be
+// checked before it's dialed.
+func (s *socks) resolve(ctx context.Context, addr *protocol.Addr) (*protocol.Addr, error) {
+	if s.remoteDNS || addr.IP != nil {
+		return addr, nil
+	}
+
+	resolver := s.resolver
+	if resolver == nil {
+		if !s.blockPrivate {
+			return addr, nil
 		}
+		resolver = &common.NetResolver{}
 	}
 
-	return errors.New("no supported SOCKS authentication method")
+	ip, err := resolver.Resolve(ctx, addr.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Addr{IP: ip, Port: addr.Port}, nil
 }
 
-func (s *socks) assertCmd() error {
-	cmd := []byte{0}
-	if _, err := s.req.Read(cmd); err != nil {
+func (s *socks) assertSOCKSVer() error {
+	ver := []byte{0}
+	if _, err := io.ReadFull(s.req, ver); err != nil {
 		return err
 	}
 
-	if cmd[0] != byte(0x01) {
-		return fmt.Errorf("unsupported SOCKS command: %#x", cmd[0])
+	// supports SOCKS5 only
+	if ver[0] != socksVer {
+		return fmt.Errorf("unsupported SOCKS version: %#x", ver[0])
 	}
 
 	return nil
 }
 
-func (s *socks) assertRsvByte() error {
-	// according to RFC1928, RSV byte must be 0x00
-	rsv := []byte{0}
-	if _, err := s.req.Read(rsv); err != nil {
-		return err
+// handshake negotiates an authentication method with the client, as of RFC1928
+// section 3, and authenticates the client with it. The client sends VER,
+// NMETHODS, and METHODS, to which the server replies VER and the selected
+// METHOD, or 0xFF if none is acceptable. It returns ctx carrying whatever the
+// Authenticator attached.
+func (s *socks) handshake(ctx context.Context) (context.Context, error) {
+	if err := s.assertSOCKSVer(); err != nil {
+		return ctx, err
 	}
 
-	if rsv[0] != byte(0x00) {
-		return fmt.Errorf("illegal SOCKS reserved field: %#x (must be 0x00)", rsv[0])
+	methodLen := []byte{0}
+	if _, err := io.ReadFull(s.req, methodLen); err != nil {
+		return ctx, err
 	}
 
-	return nil
+	methods := make([]byte, int(methodLen[0]))
+	if _, err := io.ReadFull(s.req, methods); err != nil {
+		return ctx, err
+	}
+
+	// methods are picked in order of preference of the server, methods
+	// offered but not known, e.g. GSSAPI, are skipped
+	for _, auth := range s.authenticators {
+		if bytes.IndexByte(methods, auth.Method()) < 0 {
+			continue
+		}
+
+		if _, err := s.res.Write([]byte{socksVer, auth.Method()}); err != nil {
+			return ctx, err
+		}
+
+		return auth.Authenticate(ctx, &bufferedConn{Conn: s.client, r: s.req})
+	}
+
+	s.res.Write([]byte{socksVer, methodNoAcceptable})
+	return ctx, fmt.Errorf("no acceptable SOCKS authentication method among %#x", methods)
 }
 
 func (s *socks) readDstAddr() error {
@@ -268,27 +1043,54 @@ func (s *socks) readDstAddr() error {
 }
 
 func (s *socks) reply(err error, addr *protocol.Addr) error {
+	if s.ver == socks4Ver {
+		return s.replySOCKS4(err, addr)
+	}
+
+	if s.httpConnect {
+		return s.replyHTTP(err)
+	}
+
 	rep := protocol.ErrToRep(err)
 
-	if rep > 0x08 {
+	if rep > protocol.RepAddressTypeNotSupported {
 		// this shouldn't happen anyway, but let's be sure
 		rep = protocol.RepGeneralFailure
 	}
 
-	addrBytes, err := addr.Marshal()
+	if s.tunnel {
+		_, err := s.res.Write([]byte{rep})
+		return err
+	}
+
+	return sendReply(s.res, rep, addr)
+}
+
+// sendReply writes a reply of rep, with bnd as BND.ADDR and BND.PORT, which
+// may be an IPv4 or IPv6 address, or a domain name. If bnd is nil, 0.0.0.0:0
+// is replied.
+//
+//	+----+-----+-------+------+----------+----------+
+//	|VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+//	+----+-----+-------+------+----------+----------+
+//	| 1  |  1  | X'00' |  1   | Variable |    2     |
+//	+----+-----+-------+------+----------+----------+
+func sendReply(w io.Writer, rep byte, bnd *protocol.Addr) error {
+	if bnd == nil {
+		bnd = &protocol.Addr{IP: net.IPv4zero.To4(), Port: 0}
+	}
+
+	addrBytes, err := bnd.Marshal()
 	if err != nil {
 		return err
 	}
 
 	buf := make([]byte, 3+len(addrBytes))
-	buf[0] = 0x05
+	buf[0] = socksVer
 	buf[1] = rep
 	buf[2] = 0x00
 	copy(buf[3:], addrBytes)
 
-	if _, err := s.res.Write(buf); err != nil {
-		return err
-	}
-
-	return nil
+	_, err = w.Write(buf)
+	return err
 }
@@ -0,0 +1,289 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/tabjy/groundhog/common/protocol"
+	"github.com/tabjy/groundhog/common/util"
+)
+
+// startTestServer serves cfg on a loopback listener until t is done, and
+// returns its address. Unless set otherwise, no authentication is required
+// and private destinations are allowed, so loopback servers can be reached.
+func startTestServer(t testing.TB, cfg *Config) string {
+	t.Helper()
+
+	cfg.Port = 1 // only validated, as the listener is passed in
+	if cfg.Credentials == nil && cfg.Authenticators == nil {
+		cfg.AllowNoAuth = true
+	}
+	cfg.AllowPrivateDestinations = true
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go srv.ServeListener(ln)
+	return ln.Addr().String()
+}
+
+// dialTestServer connects to a server started by startTestServer, and
+// negotiates NO AUTHENTICATION REQUIRED.
+func dialTestServer(t testing.TB, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := conn.Write([]byte{socksVer, 1, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("method %#x selected, want NO AUTHENTICATION REQUIRED", reply[1])
+	}
+	return conn
+}
+
+// readReply reads a reply to a request, failing t unless REP is want, and
+// returns BND.ADDR and BND.PORT.
+func readReply(t testing.TB, r io.Reader, want byte) *net.TCPAddr {
+	t.Helper()
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != want {
+		t.Fatalf("REP %#x, want %#x", header[1], want)
+	}
+
+	bnd, err := protocol.NewAddrFromReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.TCPAddr{IP: bnd.IP, Port: int(bnd.Port)}
+}
+
+// writeRequest writes a request of cmd to dst.
+func writeRequest(t testing.TB, w io.Writer, cmd byte, dst *protocol.Addr) {
+	t.Helper()
+
+	req, err := newRequest(cmd, dst).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tcpServer accepts connections on loopback until t is done, and sends them
+// to accepted.
+func tcpServer(t testing.TB, accepted chan<- net.Conn) *net.TCPAddr {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestConnectReplyBoundAddr(t *testing.T) {
+	accepted := make(chan net.Conn, 1)
+	dst := tcpServer(t, accepted)
+	addr := startTestServer(t, &Config{})
+
+	conn := dialTestServer(t, addr)
+	writeRequest(t, conn, cmdConnect, &protocol.Addr{IP: dst.IP.To4(), Port: uint16(dst.Port)})
+	bnd := readReply(t, conn, protocol.RepSucceeded)
+
+	target := <-accepted
+	defer target.Close()
+
+	// the outbound connection as seen by the destination
+	outbound := target.RemoteAddr().(*net.TCPAddr)
+	if !bnd.IP.Equal(outbound.IP) || bnd.Port != outbound.Port {
+		t.Fatalf("BND.ADDR:BND.PORT %v, want %v", bnd, outbound)
+	}
+}
+
+func TestSendReply(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		bnd  *protocol.Addr
+		want []byte // following VER, REP and RSV
+	}{
+		{"nil", nil, []byte{protocol.AtypIPv4, 0, 0, 0, 0, 0, 0}},
+		{"IPv4", &protocol.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, []byte{protocol.AtypIPv4, 192, 0, 2, 1, 0x04, 0x38}},
+		{
+			"IPv6", &protocol.Addr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			[]byte{protocol.AtypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+		},
+		{"domain", &protocol.Addr{Domain: "example.com", Port: 80}, []byte("\x03\x0bexample.com\x00\x50")},
+	} {
+		for rep := protocol.RepSucceeded; rep <= protocol.RepAddressTypeNotSupported; rep++ {
+			var buf bytes.Buffer
+			if err := sendReply(&buf, rep, tt.bnd); err != nil {
+				t.Fatalf("%s, REP %#x: %v", tt.name, rep, err)
+			}
+
+			want := append([]byte{socksVer, rep, 0x00}, tt.want...)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("%s, REP %#x: sent %x, want %x", tt.name, rep, buf.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	for _, tt := range []struct {
+		host string
+		dial string // host to dial
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"localhost", "localhost"},
+	} {
+		port, err := util.GetFreeTCPPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := &Config{Host: tt.host, Port: uint16(port), AllowNoAuth: true}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+
+		srv, err := NewServer(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		if err := srv.Listen(); err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		go srv.Serve()
+
+		conn, err := net.Dial("tcp", net.JoinHostPort(tt.dial, strconv.Itoa(port)))
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.host, err)
+		}
+		conn.Close()
+	}
+
+	// a port belongs in Port, not Host
+	config := &Config{Host: "[::1]:1080", Port: 1080, AllowNoAuth: true}
+	if err := config.Validate(); !errors.Is(err, ErrInvalidListenHost) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidListenHost)
+	}
+}
+
+// discardConn is a net.Conn recording whatever is written to it. It can't be
+// read from, as handshake reads from socks.req instead.
+type discardConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func FuzzHandshake(f *testing.F) {
+	for _, seed := range [][]byte{
+		{5, 1, methodNoAuth},
+		{5, 2, methodNoAuth, methodUserPass},
+		append([]byte{5, 1, methodUserPass}, "\x01\x04user\x08password"...),
+		append([]byte{5, 1, methodUserPass}, "\x01\x04user\x05wrong"...),
+		{5, 1, methodGSSAPI},
+		{5, 0},
+		{5, 3, methodNoAuth},
+		{4, 1, methodNoAuth},
+		{5},
+	} {
+		f.Add(seed)
+	}
+
+	h := &handler{authenticators: []Authenticator{
+		UserPassAuthenticator{Credentials: StaticCredentials{"user": "password"}},
+	}}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		conn := &discardConn{}
+		s := &socks{handler: h, client: conn, req: bufio.NewReader(bytes.NewReader(b)), res: conn}
+
+		ctx, err := s.handshake(context.Background())
+		if err != nil {
+			return
+		}
+
+		// only the valid credentials get through
+		if username, _ := UsernameFromContext(ctx); username != "user" {
+			t.Fatalf("authenticated as %q", username)
+		}
+		if reply := conn.written.Bytes(); !bytes.Equal(reply, []byte{socksVer, methodUserPass, userPassVer, 0x00}) {
+			t.Fatalf("replied %#x", reply)
+		}
+	})
+}
+
+func TestValidateNegativeRates(t *testing.T) {
+	for _, config := range []*Config{
+		{Port: 1080, AllowNoAuth: true, PerConnBytesPerSec: -1},
+		{Port: 1080, AllowNoAuth: true, TotalBytesPerSec: -1},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("%+v validated", config)
+		}
+	}
+}
+
+func TestNewServerNopLogger(t *testing.T) {
+	srv, err := NewServer(&Config{Port: 1080, AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Logger != nopLogger {
+		t.Fatalf("Logger %v, want nopLogger", srv.Logger)
+	}
+}
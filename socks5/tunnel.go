@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// serveTunnel serves a request from a groundhog local, which is a bare
+// destination address in the SOCKS5 encoding, i.e. ATYP, DST.ADDR, and
+// DST.PORT, without method negotiation. It's served as a CONNECT request, and
+// replied with REP only.
+//
+//	+------+----------+----------+         +-----+
+//	| ATYP | DST.ADDR | DST.PORT |  ---->  | REP |
+//	+------+----------+----------+         +-----+
+//	|  1   | Variable |    2     |         |  1  |
+//	+------+----------+----------+         +-----+
+func (s *socks) serveTunnel(ctx context.Context) error {
+	if err := s.readDstAddr(); err != nil {
+		return fmt.Errorf("failed to read tunnel request: %v", err)
+	}
+	s.client.SetDeadline(time.Time{})
+
+	s.cmd = cmdConnect
+	s.event(EventRequest, nil)
+
+	s.logger.Tracef("tunnel request from %s to %s", s.client.RemoteAddr(), s.dst.String())
+
+	return s.withHooks(ctx, s.handleConnect)
+}
+
+// serveSession serves conn from a groundhog local with Multiplex, accepting
+// yamux streams and serving each as a connection of Tunnel, until conn is
+// closed or ctx is done.
+func (h *handler) serveSession(ctx context.Context, conn net.Conn) {
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+
+	session, err := yamux.Server(conn, config)
+	if err != nil {
+		h.logger.Errorf("failed to set up multiplexing for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// streams are closed along with session, wait for them to be done
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer session.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+
+			s := socks{handler: h}
+			s.init(ctx, stream)
+		}()
+	}
+}
@@ -0,0 +1,204 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// maxUDPSize is the largest UDP payload possible over IPv4 and IPv6.
+const maxUDPSize = 65535
+
+// maxUDPTargets is the number of destinations a single association relays to
+// at once. Beyond it, the connection to the least recently added destination
+// is closed to make room.
+const maxUDPTargets = 256
+
+// handleUDPAssociate serves a UDP ASSOCIATE request, as of RFC1928 section 7.
+// A UDP socket is bound on the same IP address client connected to, and its
+// address is replied. Datagrams from the client are stripped of their SOCKS
+// UDP request header and sent to DST.ADDR:DST.PORT over a UDP connection
+// dialed with Dialer, one per destination. Datagrams coming back on such
+// connections are sent back to the client with the header prepended.
+// Fragmented datagrams (FRAG != 0) are dropped. Up to maxUDPTargets
+// destinations are relayed to at once.
+//
+// The association lasts as long as the TCP connection of the request, after
+// which the UDP socket and all dialed connections are closed.
+func (s *socks) handleUDPAssociate(ctx context.Context) error {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.local.IP})
+	if err != nil {
+		s.metrics.IncErrors("udp")
+		s.reply(err, s.local)
+		return err
+	}
+	defer relay.Close()
+
+	bnd := &protocol.Addr{
+		IP:   s.local.IP,
+		Port: uint16(relay.LocalAddr().(*net.UDPAddr).Port),
+	}
+	if err := s.reply(nil, bnd); err != nil {
+		return err
+	}
+
+	s.logger.Tracef("UDP relay for %s bound on %s", s.client.RemoteAddr(), relay.LocalAddr())
+
+	go s.relayUDP(ctx, relay)
+
+	// the TCP connection carries nothing else but signals end of association
+	// by closing, or ctx being done
+	io.Copy(ioutil.Discard, s.req)
+	return nil
+}
+
+func (s *socks) relayUDP(ctx context.Context, relay *net.UDPConn) {
+	var client *net.UDPAddr // learned from the first datagram from the client IP
+
+	targets := make(map[string]net.Conn) // keyed by destination
+	var order []string                   // keys of targets, oldest first
+	defer func() {
+		for _, target := range targets {
+			target.Close()
+		}
+	}()
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			// relay closed along with the TCP connection
+			return
+		}
+
+		if !from.IP.Equal(s.src.IP) || (client != nil && from.Port != client.Port) {
+			s.logger.Debugf("dropping UDP datagram from unknown source %s", from)
+			continue
+		}
+		client = from
+
+		payload, dst, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			s.logger.Debugf("dropping UDP datagram from %s: %v", from, err)
+			continue
+		}
+
+		resolved, err := s.resolve(ctx, dst)
+		if err != nil {
+			s.logger.Debugf("dropping UDP datagram to %s: %v", dst, err)
+			continue
+		}
+
+		if !s.allowed(dst, resolved) {
+			s.logger.Debugf("dropping UDP datagram to %s: not allowed by ruleset", dst)
+			continue
+		}
+
+		target, ok := targets[resolved.String()]
+		if !ok {
+			if len(order) >= maxUDPTargets {
+				oldest := order[0]
+				order = order[1:]
+				s.logger.Debugf("closing UDP relay to %s, too many destinations", oldest)
+				targets[oldest].Close()
+				delete(targets, oldest)
+			}
+
+			dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+			target, err = s.dialer.DialContext(dialCtx, "udp", resolved.String())
+			cancel()
+			if err != nil {
+				s.logger.Debugf("dropping UDP datagram to %s: %v", dst, err)
+				continue
+			}
+			targets[resolved.String()] = target
+			order = append(order, resolved.String())
+
+			go s.relayUDPReplies(relay, client, target, resolved)
+		}
+
+		if _, err := target.Write(payload); err != nil {
+			s.logger.Debugf("failed to relay UDP datagram to %s: %v", resolved, err)
+			continue
+		}
+		s.metrics.ObserveBytes(DirectionUp, len(payload))
+	}
+}
+
+// relayUDPReplies sends datagrams read from target back to client, as if they
+// came from from, until target is closed.
+func (s *socks) relayUDPReplies(relay *net.UDPConn, client *net.UDPAddr, target net.Conn, from *protocol.Addr) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		s.metrics.ObserveBytes(DirectionDown, n)
+
+		datagram, err := marshalUDPRequest(from, buf[:n])
+		if err != nil {
+			s.logger.Debugf("dropping UDP datagram from %s: %v", from, err)
+			continue
+		}
+
+		if _, err := relay.WriteToUDP(datagram, client); err != nil {
+			s.logger.Debugf("failed to relay UDP datagram to %s: %v", client, err)
+		}
+	}
+}
+
+// parseUDPRequest parses a SOCKS UDP request header, as of RFC1928 section 7,
+// and returns the payload following it and its destination.
+//
+//	+-----+------+------+----------+----------+----------+
+//	| RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+-----+------+------+----------+----------+----------+
+//	|  2  |  1   |  1   | Variable |    2     | Variable |
+//	+-----+------+------+----------+----------+----------+
+func parseUDPRequest(datagram []byte) ([]byte, *protocol.Addr, error) {
+	if len(datagram) < 3 {
+		return nil, nil, errors.New("datagram too short for SOCKS UDP request header")
+	}
+
+	// according to RFC1928, RSV bytes must be 0x0000
+	if rsv := uint16(datagram[0])<<8 | uint16(datagram[1]); rsv != 0x0000 {
+		return nil, nil, fmt.Errorf("illegal SOCKS UDP reserved field: %#04x (must be 0x0000)", rsv)
+	}
+
+	if datagram[2] != 0x00 {
+		return nil, nil, errors.New("fragmented datagrams are not supported")
+	}
+
+	rd := bytes.NewReader(datagram[3:])
+	dst, err := protocol.NewAddrFromReader(rd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return datagram[len(datagram)-rd.Len():], dst, nil
+}
+
+// marshalUDPRequest prepends a SOCKS UDP request header with from to payload.
+func marshalUDPRequest(from *protocol.Addr, payload []byte) ([]byte, error) {
+	addr := from
+	if ip4 := from.IP.To4(); ip4 != nil {
+		addr = &protocol.Addr{IP: ip4, Port: from.Port}
+	}
+
+	addrBytes, err := addr.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, 0, 3+len(addrBytes)+len(payload))
+	datagram = append(datagram, 0x00, 0x00, 0x00)
+	datagram = append(datagram, addrBytes...)
+	return append(datagram, payload...), nil
+}
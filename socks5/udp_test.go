@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// udpEchoServer echoes datagrams back to their sender until t is done.
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEchoServer(t)
+	addr := startTestServer(t, &Config{AllowedCommands: CommandUDPAssociate})
+
+	conn := dialTestServer(t, addr)
+	writeRequest(t, conn, cmdUDPAssociate, &protocol.Addr{IP: net.IPv4zero.To4()})
+	bnd := readReply(t, conn, protocol.RepSucceeded)
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bnd.IP, Port: bnd.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	datagram, err := marshalUDPRequest(&protocol.Addr{IP: echo.IP, Port: uint16(echo.Port)}, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a datagram is taken as dropped if nothing comes back in 200ms
+	fragmented := append([]byte(nil), datagram...)
+	fragmented[2] = 0x01
+	reserved := append([]byte(nil), datagram...)
+	reserved[0] = 0x01
+
+	for _, tt := range []struct {
+		name    string
+		send    []byte
+		relayed bool
+	}{
+		{"FRAG 0", datagram, true},
+		{"FRAG 1", fragmented, false},
+		{"RSV 0x0100", reserved, false},
+	} {
+		if _, err := client.Write(tt.send); err != nil {
+			t.Fatal(err)
+		}
+
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, maxUDPSize)
+		n, err := client.Read(buf)
+		if tt.relayed {
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			// the reply carries the header of the echo server as DST
+			if !bytes.Equal(buf[:n], datagram) {
+				t.Fatalf("%s: got %x, want %x", tt.name, buf[:n], datagram)
+			}
+		} else if err == nil {
+			t.Fatalf("%s: relayed, want dropped", tt.name)
+		}
+	}
+}
+
+func TestParseUDPRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		datagram []byte
+		ok       bool
+	}{
+		{"IPv4", []byte{0, 0, 0, protocol.AtypIPv4, 127, 0, 0, 1, 0, 53, 'x'}, true},
+		{"domain", []byte{0, 0, 0, protocol.AtypDomain, 1, 'a', 0, 53, 'x'}, true},
+		{"short", []byte{0, 0}, false},
+		{"RSV", []byte{0, 1, 0, protocol.AtypIPv4, 127, 0, 0, 1, 0, 53, 'x'}, false},
+		{"FRAG", []byte{0, 0, 1, protocol.AtypIPv4, 127, 0, 0, 1, 0, 53, 'x'}, false},
+		{"truncated", []byte{0, 0, 0, protocol.AtypIPv4, 127, 0}, false},
+	} {
+		payload, _, err := parseUDPRequest(tt.datagram)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && string(payload) != "x" {
+			t.Errorf("%s: payload %q, want \"x\"", tt.name, payload)
+		}
+	}
+}
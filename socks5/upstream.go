@@ -0,0 +1,218 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/tabjy/groundhog/common"
+	"github.com/tabjy/groundhog/common/protocol"
+)
+
+// UpstreamDialer implements common.Dialer by issuing CONNECT requests to an
+// upstream SOCKS5 server. Set it as Config.Dialer to chain SOCKS5 servers, or
+// use it on its own as a SOCKS5 client. It also satisfies proxy.Dialer and
+// proxy.ContextDialer of golang.org/x/net/proxy.
+//
+// Destinations can be IPv4 or IPv6 addresses, or domain names, which are
+// resolved by the upstream server.
+//
+// Failures of the upstream server itself, i.e. being unreachable or rejecting
+// authentication, are reported as general server failure to downstream
+// clients. Replies to the CONNECT request are passed on as is.
+type UpstreamDialer struct {
+	Host string // hostname or IP address of the upstream server
+	Port uint16 // port of the upstream server
+
+	// Username and Password, if Username is set, are used to authenticate
+	// with the upstream server with username/password (RFC1929). Otherwise,
+	// NO AUTHENTICATION REQUIRED is offered only.
+	Username string
+	Password string
+
+	// Forward dials the upstream server. If nil, net.Dialer would be used.
+	Forward common.Dialer
+}
+
+// Auth holds username/password credentials for a SOCKS5 server, as of
+// RFC1929.
+type Auth struct {
+	Username string
+	Password string
+}
+
+// Dial connects to target on network through the SOCKS5 server at proxyAddr,
+// authenticating with auth if not nil. See UpstreamDialer.
+func Dial(proxyAddr, network, target string, auth *Auth) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCKS5 server port %q", portStr)
+	}
+
+	d := &UpstreamDialer{Host: host, Port: uint16(port)}
+	if auth != nil {
+		d.Username = auth.Username
+		d.Password = auth.Password
+	}
+	return d.Dial(network, target)
+}
+
+// Dial implements Dial in common.Dialer.
+func (d *UpstreamDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext implements DialContext in common.Dialer. Only TCP networks are
+// supported. If ctx is done before the upstream server replies, the
+// connection is closed and ctx.Err() is returned.
+func (d *UpstreamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%v: network %s not supported by upstream", protocol.RepToErr(protocol.RepCommandNotSupported), network)
+	}
+
+	dst, err := protocol.NewAddrFromString(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		dst.IP = ip4
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	upstream := net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port)))
+	conn, err := forward.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return nil, fmt.Errorf("%v: failed to reach upstream %s: %v", protocol.RepToErr(protocol.RepGeneralFailure), upstream, err)
+	}
+
+	// unblock the handshake if ctx is done before it completes
+	stop := make(chan struct{})
+	watchdog := make(chan struct{})
+	go func() {
+		defer close(watchdog)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	err = d.connect(conn, r, dst)
+	close(stop)
+	<-watchdog
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if r.Buffered() > 0 {
+		// the target spoke first, e.g. a server greeting
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// connect runs method negotiation, authentication, and a CONNECT request to
+// dst over conn, reading replies from r.
+func (d *UpstreamDialer) connect(conn net.Conn, r *bufio.Reader, dst *protocol.Addr) error {
+	methods := []byte{methodNoAuth}
+	if d.Username != "" {
+		methods = []byte{methodUserPass}
+	}
+	if _, err := conn.Write(append([]byte{socksVer, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	selected := []byte{0, 0}
+	if _, err := io.ReadFull(r, selected); err != nil {
+		return err
+	}
+
+	if selected[0] != socksVer {
+		return fmt.Errorf("unsupported SOCKS version from upstream: %#x", selected[0])
+	}
+
+	switch selected[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if err := d.authenticate(conn, r); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%v: no acceptable authentication method by upstream", protocol.RepToErr(protocol.RepGeneralFailure))
+	}
+
+	req, err := newRequest(cmdConnect, dst).Marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := []byte{0, 0, 0}
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVer {
+		return fmt.Errorf("unsupported SOCKS version from upstream: %#x", reply[0])
+	}
+
+	if _, err := protocol.NewAddrFromReader(r); err != nil {
+		return err
+	}
+
+	if reply[1] != protocol.RepSucceeded {
+		return fmt.Errorf("upstream failed to connect to %s: %v", dst, protocol.RepToErr(reply[1]))
+	}
+
+	return nil
+}
+
+// authenticate runs username/password sub-negotiation, as of RFC1929.
+func (d *UpstreamDialer) authenticate(conn net.Conn, r io.Reader) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("username or password for upstream too long")
+	}
+
+	buf := []byte{userPassVer, byte(len(d.Username))}
+	buf = append(buf, d.Username...)
+	buf = append(buf, byte(len(d.Password)))
+	buf = append(buf, d.Password...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	status := []byte{0, 0}
+	if _, err := io.ReadFull(r, status); err != nil {
+		return err
+	}
+
+	if status[1] != protocol.RepSucceeded {
+		return fmt.Errorf("%v: upstream rejected credentials for user %q", protocol.RepToErr(protocol.RepGeneralFailure), d.Username)
+	}
+
+	return nil
+}